@@ -0,0 +1,90 @@
+package nrpe
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Target is a command to check on the server at Address
+type Target struct {
+	Address string
+	Command Command
+	// Timeout limits the check in addition to Client.CheckTimeout,
+	// zero means no extra limit
+	Timeout time.Duration
+}
+
+// TargetResult is the outcome of the check of a single target
+type TargetResult struct {
+	// Index of the target in the list passed to CheckAll
+	Index  int
+	Target Target
+	// Result holds the check status, it is nil if Err is set
+	Result *CommandResult
+	// Err is a connection or protocol error, the check itself
+	// didn't run or its status wasn't received
+	Err error
+}
+
+// CheckAll checks all targets running at most concurrency checks
+// at once, zero means no limit. fn is called with each result as it
+// completes, never concurrently. Targets which didn't start before
+// ctx is done get its error. CheckAll returns once fn was called
+// for every target.
+func (c *Client) CheckAll(ctx context.Context, targets []Target, concurrency int, fn func(TargetResult)) {
+	if concurrency <= 0 || concurrency > len(targets) {
+		concurrency = len(targets)
+	}
+
+	results := make(chan TargetResult, concurrency)
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	go func() {
+		for i, target := range targets {
+			if ctx.Err() != nil {
+				results <- TargetResult{Index: i, Target: target, Err: ctx.Err()}
+				continue
+			}
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results <- TargetResult{Index: i, Target: target, Err: ctx.Err()}
+				continue
+			}
+
+			wg.Add(1)
+
+			go func(i int, target Target) {
+				defer wg.Done()
+
+				result, err := c.checkTarget(ctx, target)
+
+				<-sem
+
+				results <- TargetResult{Index: i, Target: target, Result: result, Err: err}
+			}(i, target)
+		}
+
+		wg.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		fn(r)
+	}
+}
+
+func (c *Client) checkTarget(ctx context.Context, target Target) (*CommandResult, error) {
+	if target.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, target.Timeout)
+		defer cancel()
+	}
+
+	return c.Check(ctx, target.Address, target.Command)
+}
@@ -0,0 +1,113 @@
+package nrpe
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testBatchClient returns client dialing fake servers by address:
+// "ok-N" answer with their name, "down" refuses, "slow" never answers
+func testBatchClient(t *testing.T, inFlight, maxInFlight *int32) *Client {
+	server := &Server{
+		Handler: func(ctx context.Context, command Command) (*CommandResult, error) {
+			n := atomic.AddInt32(inFlight, 1)
+			defer atomic.AddInt32(inFlight, -1)
+
+			for {
+				max := atomic.LoadInt32(maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(maxInFlight, max, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+
+			return &CommandResult{StatusLine: command.Name, StatusCode: StatusWarning}, nil
+		},
+	}
+
+	var dials int32
+
+	return &Client{Policy: SSLPolicyPlain, DialContext: testDialer(t, testServe(server), 0, &dials)}
+}
+
+func TestClientCheckAll(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	client := testBatchClient(t, &inFlight, &maxInFlight)
+
+	var targets []Target
+
+	for i := 0; i < 20; i++ {
+		targets = append(targets, Target{Address: fmt.Sprintf("ok-%d", i), Command: NewCommand(fmt.Sprintf("check_%d", i))})
+	}
+
+	targets = append(targets,
+		Target{Address: "down", Command: NewCommand("check_down")},
+		Target{Address: "slow", Command: NewCommand("check_slow"), Timeout: 50 * time.Millisecond})
+
+	seen := make(map[int]bool)
+
+	client.CheckAll(context.Background(), targets, 4, func(r TargetResult) {
+		if seen[r.Index] {
+			t.Fatalf("Duplicate result of target %d", r.Index)
+		}
+
+		seen[r.Index] = true
+
+		switch r.Target.Address {
+		case "down":
+			if r.Err == nil || r.Result != nil {
+				t.Fatal("Expected connection error")
+			}
+		case "slow":
+			if r.Err != context.DeadlineExceeded {
+				t.Fatalf("Expected deadline error, got %v", r.Err)
+			}
+		default:
+			if r.Err != nil {
+				t.Fatal(r.Err)
+			}
+
+			if r.Result.StatusCode != StatusWarning || r.Result.StatusLine != targets[r.Index].Command.Name {
+				t.Fatalf("Unexpected result %+v", r.Result)
+			}
+		}
+	})
+
+	if len(seen) != len(targets) {
+		t.Fatalf("Expected %d results, got %d", len(targets), len(seen))
+	}
+
+	if maxInFlight > 4 {
+		t.Fatalf("Concurrency limit exceeded: %d", maxInFlight)
+	}
+}
+
+func TestClientCheckAllCanceled(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	client := testBatchClient(t, &inFlight, &maxInFlight)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	targets := []Target{{Address: "ok-1"}, {Address: "ok-2"}, {Address: "ok-3"}}
+
+	var results int
+
+	client.CheckAll(ctx, targets, 1, func(r TargetResult) {
+		results++
+
+		if r.Err != context.Canceled {
+			t.Fatalf("Expected canceled error, got %v", r.Err)
+		}
+	})
+
+	if results != len(targets) {
+		t.Fatalf("Expected %d results, got %d", len(targets), results)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build cgo || nrpe_purego
+// +build cgo nrpe_purego
+
+package nrpe
+
+import "testing"
+
+func BenchmarkClientServerSSL(b *testing.B) {
+	benchmarkClientServer(b, &Client{SSL: &SSLConfig{}}, &Server{SSL: &SSLConfig{}}, false)
+}
+
+func BenchmarkClientServerSSLParallel(b *testing.B) {
+	benchmarkClientServer(b, &Client{SSL: &SSLConfig{}}, &Server{SSL: &SSLConfig{}}, true)
+}
@@ -0,0 +1,98 @@
+package nrpe
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// benchmarkRoundTrip runs one request of client against server over net.Pipe
+func benchmarkRoundTrip(client *Client, server *Server) error {
+	clientConn, serverConn := net.Pipe()
+
+	c := make(chan error, 1)
+
+	go func() {
+		err := server.ServeOne(context.Background(), serverConn)
+		serverConn.Close()
+		c <- err
+	}()
+
+	_, err := client.Run(context.Background(), clientConn, NewCommand("check_bench", "arg"))
+
+	clientConn.Close()
+
+	if serverErr := <-c; err == nil {
+		err = serverErr
+	}
+
+	return err
+}
+
+// benchmarkClientServer measures round trips, serial or from parallel goroutines
+func benchmarkClientServer(b *testing.B, client *Client, server *Server, parallel bool) {
+	server.Handler = func(ctx context.Context, command Command) (*CommandResult, error) {
+		return &CommandResult{StatusLine: "OK - bench", StatusCode: StatusOK}, nil
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(2 * packetLength)
+	b.ResetTimer()
+
+	if !parallel {
+		for i := 0; i < b.N; i++ {
+			if err := benchmarkRoundTrip(client, server); err != nil {
+				b.Fatal(err)
+			}
+		}
+		return
+	}
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := benchmarkRoundTrip(client, server); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkClientServerPlain(b *testing.B) {
+	benchmarkClientServer(b, &Client{}, &Server{}, false)
+}
+
+func BenchmarkClientServerPlainParallel(b *testing.B) {
+	benchmarkClientServer(b, &Client{}, &Server{}, true)
+}
+
+func BenchmarkBuildPacket(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		p, err := buildPacket(queryPacketType, 0, "check_bench!arg", nil)
+
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		putPacket(p)
+	}
+}
+
+func BenchmarkVerifyPacket(b *testing.B) {
+	p := testBuildPacket(queryPacketType, 0, "check_bench!arg")
+	crc := binary.BigEndian.Uint32(p.crc32)
+
+	b.ReportAllocs()
+	b.SetBytes(packetLength)
+
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(p.crc32, crc)
+
+		if err := verifyPacket(p, queryPacketType); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
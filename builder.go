@@ -0,0 +1,211 @@
+package nrpe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type builderMessage struct {
+	status CommandStatus
+	text   string
+}
+
+// ResultBuilder accumulates messages, performance data and statuses
+// of the checked items and renders them into CommandResult
+// in the "SERVICE STATUS: text | perfdata" format
+type ResultBuilder struct {
+	service   string
+	status    CommandStatus
+	messages  []builderMessage
+	longText  []string
+	perfData  []PerfData
+	maxLength int
+}
+
+// NewResultBuilder creates ResultBuilder for the given service name,
+// the output is limited to the payload size of the nrpe packet
+func NewResultBuilder(service string) *ResultBuilder {
+	return &ResultBuilder{
+		service:   service,
+		status:    StatusOK,
+		maxLength: maxPacketDataLength - 1,
+	}
+}
+
+// SetMaxLength changes the output length limit
+func (b *ResultBuilder) SetMaxLength(n int) *ResultBuilder {
+	b.maxLength = n
+	return b
+}
+
+// Add records status of an item, message is omitted if empty.
+// Invalid statuses are recorded as UNKNOWN.
+func (b *ResultBuilder) Add(status CommandStatus, message string) *ResultBuilder {
+	if _, ok := statusNames[status]; !ok {
+		status = StatusUnknown
+	}
+
+	b.status = WorstStatus(b.status, status)
+
+	if message != "" {
+		b.messages = append(b.messages, builderMessage{status, message})
+	}
+
+	return b
+}
+
+// Addf records status of an item with formatted message
+func (b *ResultBuilder) Addf(status CommandStatus, format string, args ...interface{}) *ResultBuilder {
+	return b.Add(status, fmt.Sprintf(format, args...))
+}
+
+// AddLongText adds line to the long output
+func (b *ResultBuilder) AddLongText(line string) *ResultBuilder {
+	b.longText = append(b.longText, line)
+	return b
+}
+
+// AddPerfData adds performance data entries to the output
+func (b *ResultBuilder) AddPerfData(perfData ...PerfData) *ResultBuilder {
+	b.perfData = append(b.perfData, perfData...)
+	return b
+}
+
+// AddValue evaluates value against the thresholds, records its status
+// and adds it to performance data
+func (b *ResultBuilder) AddValue(label string, value float64, uom string,
+	warning, critical *Range) CommandStatus {
+
+	p := PerfData{Label: label, Value: value, UOM: uom}
+
+	if warning != nil {
+		p.Warn = warning.String()
+	}
+
+	if critical != nil {
+		p.Crit = critical.String()
+	}
+
+	status := CheckThresholds(value, warning, critical)
+
+	b.Add(status, "")
+	b.AddPerfData(p)
+
+	return status
+}
+
+// Status returns the worst status recorded so far
+func (b *ResultBuilder) Status() CommandStatus {
+	return b.status
+}
+
+// header returns "SERVICE STATUS" part of the output
+func (b *ResultBuilder) header() string {
+	if b.service == "" {
+		return b.status.String()
+	}
+
+	return b.service + " " + b.status.String()
+}
+
+// text joins messages, putting the most severe ones first,
+// so that truncation drops the least important messages
+func (b *ResultBuilder) text() string {
+	messages := make([]builderMessage, len(b.messages))
+	copy(messages, b.messages)
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return statusRank(messages[i].status) > statusRank(messages[j].status)
+	})
+
+	texts := make([]string, len(messages))
+
+	for i, m := range messages {
+		texts[i] = m.text
+	}
+
+	text := b.header()
+
+	if len(texts) > 0 {
+		text += ": " + strings.Join(texts, ", ")
+	}
+
+	return text
+}
+
+// String renders the output, truncating it to the length limit.
+// Long text is dropped first, then the text gets shortened,
+// performance data is only removed if it doesn't fit on its own.
+func (b *ResultBuilder) String() string {
+	output := PluginOutput{
+		Text:     b.text(),
+		LongText: strings.Join(b.longText, "\n"),
+		PerfData: b.perfData,
+	}
+
+	s := output.String()
+
+	if b.maxLength <= 0 || len(s) <= b.maxLength {
+		return s
+	}
+
+	longText := b.longText
+
+	for len(longText) > 0 {
+		longText = longText[:len(longText)-1]
+		output.LongText = strings.Join(longText, "\n")
+
+		if s = output.String(); len(s) <= b.maxLength {
+			return s
+		}
+	}
+
+	const ellipsis = "..."
+
+	for {
+		if s = output.String(); len(s) <= b.maxLength {
+			return s
+		}
+
+		perf := ""
+
+		if len(output.PerfData) > 0 {
+			perf = " | " + FormatPerfData(output.PerfData...)
+		}
+
+		n := b.maxLength - len(perf) - len(ellipsis)
+
+		if n >= len(b.header()) {
+			return truncateString(FormatStatusLine(output.Text), n) + ellipsis + perf
+		}
+
+		if len(output.PerfData) == 0 {
+			return truncateString(FormatStatusLine(output.Text), b.maxLength)
+		}
+
+		output.PerfData = output.PerfData[:len(output.PerfData)-1]
+	}
+}
+
+// truncateString cuts s to at most n bytes without splitting utf-8 runes
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// Result renders CommandResult with the worst recorded status
+func (b *ResultBuilder) Result() *CommandResult {
+	return &CommandResult{
+		StatusLine: b.String(),
+		StatusCode: b.status,
+	}
+}
@@ -0,0 +1,101 @@
+package nrpe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResultBuilder(t *testing.T) {
+	warning, _ := ParseRange("80")
+	critical, _ := ParseRange("90")
+
+	b := NewResultBuilder("DISK")
+
+	b.Add(StatusOK, "/ 10% used")
+	b.Addf(StatusWarning, "/var %d%% used", 85)
+	b.AddValue("/", 10, "%", warning, critical)
+	b.AddValue("/var", 85, "%", warning, critical)
+	b.AddLongText("/boot 5% used")
+
+	result := b.Result()
+
+	if result.StatusCode != StatusWarning {
+		t.Fatal("Expected WARNING")
+	}
+
+	expected := "DISK WARNING: /var 85% used, / 10% used | /=10%;80;90 /var=85%;80;90\n" +
+		"/boot 5% used"
+
+	if result.StatusLine != expected {
+		t.Fatalf("Unexpected output %q", result.StatusLine)
+	}
+
+	b.Add(StatusUnknown, "")
+
+	if b.Status() != StatusUnknown {
+		t.Fatal("Expected UNKNOWN to be worse than WARNING")
+	}
+
+	b.Add(StatusCritical, "")
+	b.Add(StatusUnknown, "")
+
+	if b.Status() != StatusCritical {
+		t.Fatal("Expected CRITICAL to be worse than UNKNOWN")
+	}
+}
+
+func TestResultBuilderEmpty(t *testing.T) {
+	result := NewResultBuilder("").Result()
+
+	if result.StatusCode != StatusOK || result.StatusLine != "OK" {
+		t.Fatalf("Unexpected result %q", result.StatusLine)
+	}
+}
+
+func TestResultBuilderInvalidStatus(t *testing.T) {
+	result := NewResultBuilder("DISK").Add(CommandStatus(7), "broken").Result()
+
+	if result.StatusCode != StatusUnknown || result.StatusLine != "DISK UNKNOWN: broken" {
+		t.Fatalf("Unexpected result %d %q", result.StatusCode, result.StatusLine)
+	}
+}
+
+func TestResultBuilderTruncation(t *testing.T) {
+	b := NewResultBuilder("LOAD")
+
+	b.Add(StatusOK, strings.Repeat("x", 2000))
+	b.AddLongText("long text")
+	b.AddPerfData(PerfData{Label: "load1", Value: 0.5})
+
+	s := b.String()
+
+	if len(s) != maxPacketDataLength-1 {
+		t.Fatalf("Unexpected length %d", len(s))
+	}
+
+	if !strings.HasPrefix(s, "LOAD OK: xxx") || !strings.HasSuffix(s, "... | load1=0.5") {
+		t.Fatalf("Unexpected output %q", s)
+	}
+
+	// perfdata which doesn't fit is dropped from the end
+	b = NewResultBuilder("LOAD").SetMaxLength(40)
+
+	b.Add(StatusOK, "load is fine")
+	b.AddPerfData(
+		PerfData{Label: "load1", Value: 0.5},
+		PerfData{Label: strings.Repeat("y", 40), Value: 1},
+	)
+
+	if s = b.String(); s != "LOAD OK: load is fine | load1=0.5" {
+		t.Fatalf("Unexpected output %q", s)
+	}
+
+	// runes are not split
+	b = NewResultBuilder("").SetMaxLength(10)
+
+	b.Add(StatusOK, "ääääää")
+
+	if s = b.String(); s != "OK: ä..." {
+		t.Fatalf("Unexpected output %q", s)
+	}
+}
@@ -0,0 +1,384 @@
+package nrpe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSLPolicy defines whether the client uses ssl
+type SSLPolicy int
+
+const (
+	// SSLPolicyAuto uses ssl if SSL settings are set
+	SSLPolicyAuto SSLPolicy = iota
+	// SSLPolicySSL always uses ssl, anonymous DH unless SSL is set
+	SSLPolicySSL
+	// SSLPolicyPlain always uses plain text
+	SSLPolicyPlain
+	// SSLPolicyPreferSSL uses ssl, but Check retries in plain text
+	// on a fresh connection if the ssl handshake fails
+	SSLPolicyPreferSSL
+)
+
+var sslPolicyNames = map[string]SSLPolicy{
+	"ssl":        SSLPolicySSL,
+	"plain":      SSLPolicyPlain,
+	"prefer-ssl": SSLPolicyPreferSSL,
+}
+
+// ParseSSLPolicy parses "ssl", "plain" or "prefer-ssl"
+func ParseSSLPolicy(s string) (SSLPolicy, error) {
+	if policy, ok := sslPolicyNames[s]; ok {
+		return policy, nil
+	}
+
+	return 0, fmt.Errorf("nrpe: unknown ssl policy %q", s)
+}
+
+// Client runs nrpe commands with the given settings
+type Client struct {
+	// SSL settings, plain text is used if nil unless Policy says otherwise
+	SSL *SSLConfig
+	// Policy defines whether ssl is used
+	Policy SSLPolicy
+	// DialContext is used by Check to connect, net.Dialer if nil,
+	// which tries all resolved addresses racing IPv6 and IPv4
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// FallbackDelay is the wait of the default dialer before trying
+	// IPv4 while IPv6 connection is pending, zero means 300ms
+	FallbackDelay time.Duration
+	// Resolver is used by the default dialer and LookupSRV,
+	// net.DefaultResolver if nil
+	Resolver *net.Resolver
+	// Timeout limits each network operation, zero means no timeout
+	Timeout time.Duration
+	// ConnectTimeout, HandshakeTimeout, ReadTimeout and WriteTimeout
+	// limit the single operations, Timeout is used if zero
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	// CheckTimeout limits the whole check including retries, zero means no limit
+	CheckTimeout time.Duration
+	// Retry policy of Check for failed connects and handshakes
+	Retry RetryPolicy
+	// Rand is the source of packet padding, e.g. crypto/rand.Reader
+	// for crypto-grade padding. It must be safe for concurrent use
+	// if the client is, goroutine safe pseudo random source is used if nil.
+	Rand io.Reader
+	// StatusMap remaps received statuses of all checks, nil keeps them.
+	// Failures are still returned as errors, StatusMap.FailureStatus
+	// maps them to status.
+	StatusMap *StatusMap
+}
+
+// handshakeError marks failed ssl handshake, which allows plain text fallback
+type handshakeError struct {
+	error
+}
+
+func (e handshakeError) Unwrap() error {
+	return e.error
+}
+
+// dialError marks failed connect, which allows trying other addresses
+type dialError struct {
+	error
+}
+
+func (e dialError) Unwrap() error {
+	return e.error
+}
+
+// Run sends command over conn and reads the result. Deadline and
+// cancellation of ctx interrupt network operations. SSLPolicyPreferSSL
+// behaves like SSLPolicySSL as there is a single connection.
+// The ssl handshake is run by Run itself, limited by HandshakeTimeout.
+// Conn stays open and owned by the caller, so ssl close_notify isn't sent.
+func (c *Client) Run(ctx context.Context, conn net.Conn, command Command) (*CommandResult, error) {
+	ctx, cancel := c.checkContext(ctx)
+	defer cancel()
+
+	result, err := c.run(ctx, conn, command, c.sslConfig(), false)
+
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
+	}
+
+	return c.remapStatus(command, result), err
+}
+
+// Check connects to address and runs command, the connection is closed
+// afterwards, ssl connections send close_notify. With SSLPolicyPreferSSL
+// a failed ssl handshake is retried in plain text on a fresh connection,
+// the result has nil SSL state then. Failures are retried by Retry policy.
+func (c *Client) Check(ctx context.Context, address string, command Command) (*CommandResult, error) {
+	ctx, cancel := c.checkContext(ctx)
+	defer cancel()
+
+	result, err := c.checkRetry(ctx, address, command)
+
+	return c.remapStatus(command, result), err
+}
+
+// checkRetry runs the check retried by Retry policy, ctx is already
+// limited by CheckTimeout
+func (c *Client) checkRetry(ctx context.Context, address string, command Command) (*CommandResult, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := c.checkOnce(ctx, address, command)
+
+		if err == nil || attempt >= c.Retry.MaxAttempts || !c.Retry.retryable(err) {
+			return result, err
+		}
+
+		if err = sleepContext(ctx, c.Retry.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *Client) checkOnce(ctx context.Context, address string, command Command) (*CommandResult, error) {
+	config := c.sslConfig()
+
+	result, err := c.check(ctx, address, command, config)
+
+	var hsErr handshakeError
+
+	if err != nil && c.Policy == SSLPolicyPreferSSL && contextError(ctx) == nil && errors.As(err, &hsErr) {
+		result, err = c.check(ctx, address, command, nil)
+	}
+
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return nil, ctxErr
+		}
+	}
+
+	return result, err
+}
+
+func (c *Client) check(ctx context.Context, address string, command Command, config *SSLConfig) (*CommandResult, error) {
+	dial := c.DialContext
+
+	if dial == nil {
+		dial = (&net.Dialer{FallbackDelay: c.FallbackDelay, Resolver: c.Resolver}).DialContext
+	}
+
+	start := time.Now()
+
+	dialCtx := ctx
+
+	if timeout := orTimeout(c.ConnectTimeout, c.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	conn, err := dial(dialCtx, "tcp", address)
+
+	if err != nil {
+		return nil, dialError{err}
+	}
+
+	defer conn.Close()
+
+	connectDuration := time.Since(start)
+
+	result, err := c.run(ctx, conn, command, config, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.Address = address
+	result.ConnectDuration = connectDuration
+
+	return result, nil
+}
+
+// CheckAddresses runs command on the first of addresses which accepts
+// the connection, the next one is tried only if connecting fails.
+// Address of the result reports which one answered. CheckTimeout
+// limits all the addresses together.
+func (c *Client) CheckAddresses(ctx context.Context, addresses []string, command Command) (*CommandResult, error) {
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("nrpe: no address to check")
+	}
+
+	ctx, cancel := c.checkContext(ctx)
+	defer cancel()
+
+	var errs []error
+
+	for _, address := range addresses {
+		result, err := c.checkRetry(ctx, address, command)
+
+		var dialErr dialError
+
+		if err == nil || !errors.As(err, &dialErr) {
+			return c.remapStatus(command, result), err
+		}
+
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// LookupSRV resolves DNS SRV record name, e.g. "_nrpe._tcp.example.com",
+// to addresses ordered by priority and randomized by weight. StatusMap
+// classifies failed lookups as failed connects or timeouts.
+func (c *Client) LookupSRV(ctx context.Context, name string) ([]string, error) {
+	resolver := c.Resolver
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+
+	if err != nil {
+		return nil, dialError{fmt.Errorf("nrpe: cannot resolve %s: %w", name, err)}
+	}
+
+	addresses := make([]string, len(records))
+
+	for i, srv := range records {
+		addresses[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+	}
+
+	return addresses, nil
+}
+
+// remapStatus applies StatusMap to the received result
+func (c *Client) remapStatus(command Command, result *CommandResult) *CommandResult {
+	if c.StatusMap != nil && result != nil {
+		result.StatusCode = c.StatusMap.RemoteStatus(command.Name, result.StatusCode)
+	}
+
+	return result
+}
+
+// checkContext limits ctx by CheckTimeout
+func (c *Client) checkContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.CheckTimeout > 0 {
+		return context.WithTimeout(ctx, c.CheckTimeout)
+	}
+
+	return ctx, func() {}
+}
+
+// sslConfig returns ssl settings according to the policy, nil for plain text
+func (c *Client) sslConfig() *SSLConfig {
+	switch c.Policy {
+	case SSLPolicyPlain:
+		return nil
+	case SSLPolicySSL, SSLPolicyPreferSSL:
+		if c.SSL == nil {
+			return anonymousSSLConfig
+		}
+	}
+
+	return c.SSL
+}
+
+// run sends command over conn, ssl connection is closed with close_notify
+// if the connection is owned, otherwise only ssl resources are released
+func (c *Client) run(ctx context.Context, conn net.Conn, command Command, config *SSLConfig, owned bool) (*CommandResult, error) {
+	var err error
+	var ssl sslConnection
+	var handshakeDuration time.Duration
+
+	remoteAddr := conn.RemoteAddr()
+
+	if ctx.Done() != nil {
+		cc := newContextConn(ctx, conn)
+		defer cc.stop()
+		conn = cc
+	}
+
+	// setup ssl connection
+	if config != nil {
+		ssl, err = newSSLClient(conn, config)
+		if err != nil {
+			return nil, err
+		}
+
+		if owned {
+			defer ssl.Close()
+		} else {
+			defer ssl.Clean()
+		}
+
+		start := time.Now()
+
+		if err = sslHandshake(ctx, ssl, orTimeout(c.HandshakeTimeout, c.Timeout)); err != nil {
+			return nil, handshakeError{err}
+		}
+
+		handshakeDuration = time.Since(start)
+
+		conn = ssl
+	}
+
+	statusLine := command.toStatusLine()
+
+	if len(statusLine) >= maxPacketDataLength {
+		return nil, fmt.Errorf("nrpe: Command is too long: got %d, max allowed %d",
+			len(statusLine), maxPacketDataLength-1)
+	}
+
+	request, err := buildPacket(queryPacketType, 0, statusLine, c.Rand)
+
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	err = writePacket(conn, orTimeout(c.WriteTimeout, c.Timeout), request)
+
+	putPacket(request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := getPacket()
+	defer putPacket(response)
+
+	if err = readPacket(conn, orTimeout(c.ReadTimeout, c.Timeout), response); err != nil {
+		return nil, err
+	}
+
+	roundTripDuration := time.Since(start)
+
+	if err = verifyPacket(response, responsePacketType); err != nil {
+		return nil, err
+	}
+
+	var result *CommandResult
+
+	if result, err = readCommandResult(response); err != nil {
+		return nil, err
+	}
+
+	if ssl != nil {
+		result.SSL = ssl.sslState()
+	}
+
+	result.RemoteAddr = remoteAddr
+	result.HandshakeDuration = handshakeDuration
+	result.RoundTripDuration = roundTripDuration
+
+	return result, nil
+}
@@ -0,0 +1,392 @@
+package nrpe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testDialer returns dial function serving each connection with serve,
+// the first failures dials and address "down" are refused, address
+// "slow" is accepted but never served. Dials are counted.
+func testDialer(t *testing.T, serve func(conn net.Conn), failures int32, dials *int32) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if atomic.AddInt32(dials, 1) <= failures || address == "down" {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("connection refused")}
+		}
+
+		sock := testCreateSocketPair(t)
+
+		t.Cleanup(func() {
+			sock.Close()
+		})
+
+		if address != "slow" {
+			go func() {
+				serve(sock.server)
+				sock.server.Close()
+			}()
+		}
+
+		return sock.client, nil
+	}
+}
+
+// testServe returns serve function of server, which answers OK
+// unless it has its own handler
+func testServe(server *Server) func(conn net.Conn) {
+	if server.Handler == nil {
+		server.Handler = func(ctx context.Context, command Command) (*CommandResult, error) {
+			return &CommandResult{StatusLine: "OK", StatusCode: StatusOK}, nil
+		}
+	}
+
+	return func(conn net.Conn) {
+		server.ServeOne(context.Background(), conn)
+	}
+}
+
+func TestClientCheckAddresses(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	client := testBatchClient(t, &inFlight, &maxInFlight)
+
+	result, err := client.CheckAddresses(context.Background(), []string{"down", "ok-1", "ok-2"}, NewCommand("check"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Address != "ok-1" {
+		t.Fatalf("Expected answer of ok-1, got %q", result.Address)
+	}
+
+	_, err = client.CheckAddresses(context.Background(), []string{"down", "down"}, NewCommand("check"))
+
+	var opErr *net.OpError
+
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		t.Fatalf("Expected dial error, got %v", err)
+	}
+
+	if _, err = client.CheckAddresses(context.Background(), nil, NewCommand("check")); err == nil {
+		t.Fatal("Expected error without addresses")
+	}
+}
+
+func TestClientCheckAddressesTimeout(t *testing.T) {
+	var dials int32
+
+	// every dial hangs until the check is cancelled
+	client := &Client{Policy: SSLPolicyPlain, CheckTimeout: 200 * time.Millisecond}
+	client.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	}
+
+	start := time.Now()
+
+	_, err := client.CheckAddresses(context.Background(), []string{"a", "b", "c"}, NewCommand("check"))
+
+	// a timeout per address would take three times as long
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected check timeout to bound all the addresses, took %v", elapsed)
+	}
+
+	if !errors.Is(err, context.DeadlineExceeded) || atomic.LoadInt32(&dials) > 2 {
+		t.Fatalf("Expected check timeout, got %v after %d dials", err, dials)
+	}
+}
+
+// testServeSRV answers DNS query read from conn with SRV records,
+// the resolver uses TCP framing as conn isn't net.PacketConn
+func testServeSRV(conn net.Conn, records []net.SRV) {
+	defer conn.Close()
+
+	var length [2]byte
+
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return
+	}
+
+	query := make([]byte, binary.BigEndian.Uint16(length[:]))
+
+	if _, err := io.ReadFull(conn, query); err != nil {
+		return
+	}
+
+	// question follows 12 bytes header: name labels, type and class
+	end := 12
+
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+
+	end += 5
+
+	msg := append([]byte{query[0], query[1], 0x81, 0x80, 0, 1, 0, byte(len(records)), 0, 0, 0, 0}, query[12:end]...)
+
+	for _, srv := range records {
+		var target []byte
+
+		for _, label := range strings.Split(strings.TrimSuffix(srv.Target, "."), ".") {
+			target = append(append(target, byte(len(label))), label...)
+		}
+
+		target = append(target, 0)
+
+		// name pointer to the question, type SRV, class IN, ttl
+		msg = append(msg, 0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 60)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(6+len(target)))
+		msg = binary.BigEndian.AppendUint16(msg, srv.Priority)
+		msg = binary.BigEndian.AppendUint16(msg, srv.Weight)
+		msg = binary.BigEndian.AppendUint16(msg, srv.Port)
+		msg = append(msg, target...)
+	}
+
+	conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+}
+
+func TestClientLookupSRV(t *testing.T) {
+	records := []net.SRV{
+		{Target: "backup.example.com.", Port: 5667, Priority: 20, Weight: 1},
+		{Target: "agent.example.com.", Port: 5666, Priority: 10, Weight: 1},
+	}
+
+	client := &Client{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				clientConn, serverConn := net.Pipe()
+				go testServeSRV(serverConn, records)
+				return clientConn, nil
+			},
+		},
+	}
+
+	addresses, err := client.LookupSRV(context.Background(), "_nrpe._tcp.example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"agent.example.com:5666", "backup.example.com:5667"}
+
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Expected %v, got %v", expected, addresses)
+	}
+}
+
+func TestClientPreferSSL(t *testing.T) {
+	testRequireSSL(t)
+
+	var dials int32
+
+	client := &Client{Policy: SSLPolicyPreferSSL, Timeout: 5 * time.Second}
+	client.DialContext = testDialer(t, testServe(&Server{}), 0, &dials)
+
+	result, err := client.Check(context.Background(), "plain", NewCommand("check_plain"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.SSL != nil || dials != 2 {
+		t.Fatalf("Expected plain text fallback, got %+v after %d dials", result.SSL, dials)
+	}
+
+	dials = 0
+	client.DialContext = testDialer(t, testServe(&Server{SSL: &SSLConfig{}}), 0, &dials)
+
+	result, err = client.Check(context.Background(), "ssl", NewCommand("check_ssl"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.SSL == nil || dials != 1 {
+		t.Fatalf("Expected ssl connection after %d dials", dials)
+	}
+}
+
+func TestClientPolicySSL(t *testing.T) {
+	testRequireSSL(t)
+
+	var dials int32
+
+	client := &Client{Policy: SSLPolicySSL, Timeout: 5 * time.Second}
+	client.DialContext = testDialer(t, testServe(&Server{}), 0, &dials)
+
+	if _, err := client.Check(context.Background(), "plain", NewCommand("check_plain")); err == nil || dials != 1 {
+		t.Fatalf("Expected handshake error without retry, got %v after %d dials", err, dials)
+	}
+
+	dials = 0
+	client = &Client{SSL: &SSLConfig{}, Policy: SSLPolicyPlain}
+	client.DialContext = testDialer(t, testServe(&Server{}), 0, &dials)
+
+	result, err := client.Check(context.Background(), "plain", NewCommand("check_plain"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.SSL != nil {
+		t.Fatal("Expected plain text connection")
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	testRequireSSL(t)
+
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	// nobody talks to the client
+	client := Client{SSL: &SSLConfig{}, Timeout: time.Minute, HandshakeTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+
+	if _, err := client.Run(context.Background(), sock.client, NewCommand("check")); err == nil {
+		t.Fatal("Expected handshake timeout")
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("Handshake timeout wasn't used")
+	}
+}
+
+func TestClientCheckMetadata(t *testing.T) {
+	testRequireSSL(t)
+
+	var dials int32
+
+	server := &Server{SSL: &SSLConfig{}}
+
+	client := &Client{SSL: &SSLConfig{}, Timeout: 5 * time.Second}
+	client.DialContext = testDialer(t, testServe(server), 0, &dials)
+
+	handler := server.Handler
+
+	server.Handler = func(ctx context.Context, command Command) (*CommandResult, error) {
+		if info := RequestInfoFromContext(ctx); info == nil || info.HandshakeDuration <= 0 {
+			t.Errorf("Unexpected request info %+v", info)
+		}
+		return handler(ctx, command)
+	}
+
+	result, err := client.Check(context.Background(), "ssl", NewCommand("check_metadata"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.SSL == nil || result.HandshakeDuration <= 0 || result.ConnectDuration <= 0 ||
+		result.RoundTripDuration <= 0 || result.RemoteAddr == nil || result.Truncated {
+		t.Fatalf("Unexpected metadata %+v", result)
+	}
+}
+
+func TestClientCheckCloseNotify(t *testing.T) {
+	testRequireSSL(t)
+
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	c := make(chan error, 1)
+
+	go func() {
+		ssl, err := newSSLServerConn(sock.server, &SSLConfig{})
+
+		if err != nil {
+			c <- err
+			return
+		}
+
+		defer ssl.Clean()
+
+		request := getPacket()
+		defer putPacket(request)
+
+		if err = readPacket(ssl, 0, request); err != nil {
+			c <- err
+			return
+		}
+
+		if err = writePacket(ssl, 0, testBuildPacket(responsePacketType, uint16(StatusOK), "OK")); err != nil {
+			c <- err
+			return
+		}
+
+		_, err = ssl.Read(make([]byte, 1))
+		c <- err
+	}()
+
+	client := &Client{SSL: &SSLConfig{}, Timeout: 5 * time.Second}
+	client.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return sock.client, nil
+	}
+
+	if _, err := client.Check(context.Background(), "ssl", NewCommand("check_close")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-c; err != io.EOF {
+		t.Fatalf("Expected close_notify, got %v", err)
+	}
+}
+
+func TestClientTimeoutFailure(t *testing.T) {
+	testRequireSSL(t)
+
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	sl, err := newSSLServerConn(sock.server, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sl.Clean()
+
+	// the server completes the handshake, but never answers
+	c := make(chan error, 1)
+
+	go func() {
+		c <- sl.Handshake(context.Background())
+	}()
+
+	client := Client{SSL: anonymousSSLConfig, ReadTimeout: 50 * time.Millisecond}
+
+	_, err = client.Run(context.Background(), sock.client, NewCommand("check"))
+
+	if failure := classifyFailure(err); failure != FailureTimeout {
+		t.Fatalf("Expected timeout failure of read, got %d: %v", failure, err)
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody talks to the client
+	other := testCreateSocketPair(t)
+	defer other.Close()
+
+	client = Client{SSL: anonymousSSLConfig, HandshakeTimeout: 50 * time.Millisecond}
+
+	_, err = client.Run(context.Background(), other.client, NewCommand("check"))
+
+	if failure := classifyFailure(err); failure != FailureTimeout {
+		t.Fatalf("Expected timeout failure of handshake, got %d: %v", failure, err)
+	}
+}
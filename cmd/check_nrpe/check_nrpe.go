@@ -11,37 +11,86 @@ Usage:
 	nrpe: [flag] [--] [arglist]
 
 The flags are:
+	-attempts int
+		attempts of checks failing to connect or handshake (default 1)
+	-ca string
+		CA certificate file to verify the server with
+	-cert string
+		client certificate file
+	-check-timeout duration
+		overall timeout of the check
+	-cipher-list string
+		OpenSSL cipher list (default "ADH" without certificates)
 	-command string
 		command to execute (default "version")
+	-connect-error-status value
+		status of failed connects (default UNKNOWN)
+	-connect-timeout duration
+		connect timeout (defaults to -timeout)
+	-handshake-timeout duration
+		ssl handshake timeout (defaults to -timeout)
 	-host string
-		hostname to connect (default "127.0.0.1")
+		hostname to connect, comma separated hosts are tried in order (default "127.0.0.1")
+	-key string
+		client private key file (defaults to -cert)
 	-port int
 		port number (default 5666)
+	-protocol-error-status value
+		status of other failures, e.g. ssl handshake or invalid response (default UNKNOWN)
+	-read-timeout duration
+		read timeout (defaults to -timeout)
+	-retry-backoff duration
+		wait before the first retry, doubled for every next one (default 100ms)
+	-retry-max-backoff duration
+		maximum wait between retries (default 2s)
+	-retry-on string
+		comma separated retried failures, connect or handshake (default "connect,handshake")
+	-srv string
+		DNS SRV record to discover the hosts, e.g. _nrpe._tcp.example.com
 	-ssl
 		use ssl (default true)
+	-ssl-options string
+		comma separated ssl options, e.g. no_ticket,cipher_server_preference
+	-ssl-policy string
+		ssl, plain or prefer-ssl, overrides -ssl
+	-ssl-version string
+		allowed ssl versions, e.g. TLSv1.2 or TLSv1.2+
+	-status-map string
+		comma separated rules remapping received status, FROM=TO or COMMAND:FROM=TO, e.g. WARNING=OK
 	-timeout duration
 		network timeout
+	-timeout-status value
+		status of timeouts (default UNKNOWN)
+	-write-timeout duration
+		write timeout (defaults to -timeout)
 
 
 */
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/envimate/nrpe"
 )
 
 func main() {
-	var cmd, host string
+	var cmd, host, srv string
 	var port int
 	var isSSL bool
-	var timeout time.Duration
+	var timeout, connectTimeout, handshakeTimeout, readTimeout, writeTimeout, checkTimeout time.Duration
+	var sslConfig nrpe.SSLConfig
+	var sslVersion, sslOptions, sslPolicy, retryOn, statusRules string
+	var connectErrorStatus, timeoutStatus, protocolErrorStatus nrpe.CommandStatus
+	var retry nrpe.RetryPolicy
 
 	cmdFlag := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
@@ -51,34 +100,143 @@ func main() {
 		cmdFlag.PrintDefaults()
 	}
 
-	cmdFlag.StringVar(&host, "host", "127.0.0.1", "hostname to connect")
+	cmdFlag.StringVar(&host, "host", "127.0.0.1", "hostname to connect, comma separated hosts are tried in order")
+	cmdFlag.StringVar(&srv, "srv", "", "DNS SRV record to discover the hosts, e.g. _nrpe._tcp.example.com")
 	cmdFlag.IntVar(&port, "port", 5666, "port number")
 	cmdFlag.BoolVar(&isSSL, "ssl", true, "use ssl")
+	cmdFlag.StringVar(&sslPolicy, "ssl-policy", "", "ssl, plain or prefer-ssl, overrides -ssl")
 	cmdFlag.StringVar(&cmd, "command", "version", "command to execute")
 	cmdFlag.DurationVar(&timeout, "timeout", 0, "network timeout")
+	cmdFlag.DurationVar(&connectTimeout, "connect-timeout", 0, "connect timeout (defaults to -timeout)")
+	cmdFlag.DurationVar(&handshakeTimeout, "handshake-timeout", 0, "ssl handshake timeout (defaults to -timeout)")
+	cmdFlag.DurationVar(&readTimeout, "read-timeout", 0, "read timeout (defaults to -timeout)")
+	cmdFlag.DurationVar(&writeTimeout, "write-timeout", 0, "write timeout (defaults to -timeout)")
+	cmdFlag.DurationVar(&checkTimeout, "check-timeout", 0, "overall timeout of the check")
+	cmdFlag.StringVar(&sslConfig.CertFile, "cert", "", "client certificate file")
+	cmdFlag.StringVar(&sslConfig.KeyFile, "key", "", "client private key file (defaults to -cert)")
+	cmdFlag.StringVar(&sslConfig.CAFile, "ca", "", "CA certificate file to verify the server with")
+	cmdFlag.StringVar(&sslConfig.CipherList, "cipher-list", "",
+		"OpenSSL cipher list (default \"ADH\" without certificates)")
+	cmdFlag.IntVar(&retry.MaxAttempts, "attempts", 1, "attempts of checks failing to connect or handshake")
+	cmdFlag.DurationVar(&retry.Backoff, "retry-backoff", 100*time.Millisecond,
+		"wait before the first retry, doubled for every next one")
+	cmdFlag.DurationVar(&retry.MaxBackoff, "retry-max-backoff", 2*time.Second, "maximum wait between retries")
+	cmdFlag.StringVar(&retryOn, "retry-on", "connect,handshake", "comma separated retried failures, connect or handshake")
+	cmdFlag.TextVar(&connectErrorStatus, "connect-error-status", nrpe.CommandStatus(nrpe.StatusUnknown),
+		"status of failed connects")
+	cmdFlag.TextVar(&timeoutStatus, "timeout-status", nrpe.CommandStatus(nrpe.StatusUnknown), "status of timeouts")
+	cmdFlag.TextVar(&protocolErrorStatus, "protocol-error-status", nrpe.CommandStatus(nrpe.StatusUnknown),
+		"status of other failures, e.g. ssl handshake or invalid response")
+	cmdFlag.StringVar(&statusRules, "status-map", "",
+		"comma separated rules remapping received status, FROM=TO or COMMAND:FROM=TO, e.g. WARNING=OK")
+	cmdFlag.StringVar(&sslVersion, "ssl-version", "", "allowed ssl versions, e.g. TLSv1.2 or TLSv1.2+")
+	cmdFlag.StringVar(&sslOptions, "ssl-options", "",
+		"comma separated ssl options, e.g. no_ticket,cipher_server_preference")
 
 	cmdFlag.Parse(os.Args[1:])
 
-	conn, err := net.DialTimeout(
-		"tcp",
-		net.JoinHostPort(host, strconv.Itoa(port)),
-		timeout,
-	)
+	var err error
 
-	if err != nil {
-		fmt.Printf("nrpe: error while connecting %s\n", err)
+	if sslVersion != "" {
+		if sslConfig.MinVersion, sslConfig.MaxVersion, err = nrpe.ParseSSLVersion(sslVersion); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(int(nrpe.StatusUnknown))
+		}
+	}
+
+	if sslConfig.Options, err = nrpe.ParseSSLOptions(sslOptions); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(int(nrpe.StatusUnknown))
+	}
+
+	if retry.On, err = nrpe.ParseRetryOn(retryOn); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(int(nrpe.StatusUnknown))
 	}
 
+	// spread retries of many checks started at once
+	retry.Jitter = 0.2
+
+	statusMap := nrpe.StatusMap{
+		Failures: map[nrpe.Failure]nrpe.CommandStatus{
+			nrpe.FailureConnect:  connectErrorStatus,
+			nrpe.FailureTimeout:  timeoutStatus,
+			nrpe.FailureProtocol: protocolErrorStatus,
+		},
+	}
+
+	if statusMap.Rules, err = nrpe.ParseStatusRules(statusRules); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(int(nrpe.StatusUnknown))
+	}
+
+	client := nrpe.Client{
+		SSL:              &sslConfig,
+		Policy:           nrpe.SSLPolicySSL,
+		Timeout:          timeout,
+		ConnectTimeout:   connectTimeout,
+		HandshakeTimeout: handshakeTimeout,
+		ReadTimeout:      readTimeout,
+		WriteTimeout:     writeTimeout,
+		CheckTimeout:     checkTimeout,
+		Retry:            retry,
+		StatusMap:        &statusMap,
+	}
+
+	if !isSSL {
+		client.Policy = nrpe.SSLPolicyPlain
+	}
+
+	if sslPolicy != "" {
+		if client.Policy, err = nrpe.ParseSSLPolicy(sslPolicy); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(int(nrpe.StatusUnknown))
+		}
+	}
+
 	args := cmdFlag.Args()
 
 	command := nrpe.NewCommand(cmd, args...)
 
-	result, err := nrpe.Run(conn, command, isSSL, timeout)
+	var addresses []string
+
+	if srv != "" {
+		if addresses, err = client.LookupSRV(context.Background(), srv); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(int(statusMap.FailureStatus(err)))
+		}
+	} else {
+		for _, h := range strings.Split(host, ",") {
+			// hosts may carry own port
+			if _, _, err := net.SplitHostPort(h); err == nil {
+				addresses = append(addresses, h)
+			} else {
+				addresses = append(addresses, net.JoinHostPort(h, strconv.Itoa(port)))
+			}
+		}
+	}
+
+	result, err := client.CheckAddresses(context.Background(), addresses, command)
+
+	var opErr *net.OpError
+
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		// errors of all addresses on one status line
+		fmt.Printf("nrpe: error while connecting %s\n", strings.ReplaceAll(err.Error(), "\n", "; "))
+		os.Exit(int(statusMap.FailureStatus(err)))
+	}
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(int(nrpe.StatusUnknown))
+		os.Exit(int(statusMap.FailureStatus(err)))
+	}
+
+	if client.Policy == nrpe.SSLPolicyPreferSSL && result.SSL == nil {
+		fmt.Fprintf(os.Stderr, "nrpe: ssl handshake failed, used plain text\n")
+	}
+
+	if len(addresses) > 1 {
+		fmt.Fprintf(os.Stderr, "nrpe: answered by %s (%v)\n", result.Address, result.RemoteAddr)
 	}
 
 	fmt.Printf("%s\n", result.StatusLine)
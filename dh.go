@@ -0,0 +1,235 @@
+package nrpe
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+)
+
+// DHGroup selects well-known DH group used by the server
+// for anonymous DH cipher suites
+type DHGroup int
+
+const (
+	// DHGroupDefault is 2048-bit ffdhe2048 group
+	DHGroupDefault DHGroup = iota
+	// DHGroupFFDHE2048 is 2048-bit group of RFC 7919
+	DHGroupFFDHE2048
+	// DHGroupFFDHE3072 is 3072-bit group of RFC 7919
+	DHGroupFFDHE3072
+	// DHGroupFFDHE4096 is 4096-bit group of RFC 7919
+	DHGroupFFDHE4096
+	// DHGroupMODP2048 is 2048-bit MODP group 14 of RFC 3526
+	DHGroupMODP2048
+	// DHGroupMODP3072 is 3072-bit MODP group 15 of RFC 3526
+	DHGroupMODP3072
+	// DHGroupMODP4096 is 4096-bit MODP group 16 of RFC 3526
+	DHGroupMODP4096
+)
+
+// minDHBits is the smallest prime accepted, current OpenSSL
+// rejects smaller ones anyway
+const minDHBits = 1024
+
+// primes of the well-known groups in hex, parsed on first use
+const (
+	rfc7919FFDHE2048 = "FFFFFFFFFFFFFFFFADF85458A2BB4A9AAFDC5620273D3CF1D8B9C583CE2D3695" +
+		"A9E13641146433FBCC939DCE249B3EF97D2FE363630C75D8F681B202AEC4617A" +
+		"D3DF1ED5D5FD65612433F51F5F066ED0856365553DED1AF3B557135E7F57C935" +
+		"984F0C70E0E68B77E2A689DAF3EFE8721DF158A136ADE73530ACCA4F483A797A" +
+		"BC0AB182B324FB61D108A94BB2C8E3FBB96ADAB760D7F4681D4F42A3DE394DF4" +
+		"AE56EDE76372BB190B07A7C8EE0A6D709E02FCE1CDF7E2ECC03404CD28342F61" +
+		"9172FE9CE98583FF8E4F1232EEF28183C3FE3B1B4C6FAD733BB5FCBC2EC22005" +
+		"C58EF1837D1683B2C6F34A26C1B2EFFA886B423861285C97FFFFFFFFFFFFFFFF"
+	rfc7919FFDHE3072 = "FFFFFFFFFFFFFFFFADF85458A2BB4A9AAFDC5620273D3CF1D8B9C583CE2D3695" +
+		"A9E13641146433FBCC939DCE249B3EF97D2FE363630C75D8F681B202AEC4617A" +
+		"D3DF1ED5D5FD65612433F51F5F066ED0856365553DED1AF3B557135E7F57C935" +
+		"984F0C70E0E68B77E2A689DAF3EFE8721DF158A136ADE73530ACCA4F483A797A" +
+		"BC0AB182B324FB61D108A94BB2C8E3FBB96ADAB760D7F4681D4F42A3DE394DF4" +
+		"AE56EDE76372BB190B07A7C8EE0A6D709E02FCE1CDF7E2ECC03404CD28342F61" +
+		"9172FE9CE98583FF8E4F1232EEF28183C3FE3B1B4C6FAD733BB5FCBC2EC22005" +
+		"C58EF1837D1683B2C6F34A26C1B2EFFA886B4238611FCFDCDE355B3B6519035B" +
+		"BC34F4DEF99C023861B46FC9D6E6C9077AD91D2691F7F7EE598CB0FAC186D91C" +
+		"AEFE130985139270B4130C93BC437944F4FD4452E2D74DD364F2E21E71F54BFF" +
+		"5CAE82AB9C9DF69EE86D2BC522363A0DABC521979B0DEADA1DBF9A42D5C4484E" +
+		"0ABCD06BFA53DDEF3C1B20EE3FD59D7C25E41D2B66C62E37FFFFFFFFFFFFFFFF"
+	rfc7919FFDHE4096 = "FFFFFFFFFFFFFFFFADF85458A2BB4A9AAFDC5620273D3CF1D8B9C583CE2D3695" +
+		"A9E13641146433FBCC939DCE249B3EF97D2FE363630C75D8F681B202AEC4617A" +
+		"D3DF1ED5D5FD65612433F51F5F066ED0856365553DED1AF3B557135E7F57C935" +
+		"984F0C70E0E68B77E2A689DAF3EFE8721DF158A136ADE73530ACCA4F483A797A" +
+		"BC0AB182B324FB61D108A94BB2C8E3FBB96ADAB760D7F4681D4F42A3DE394DF4" +
+		"AE56EDE76372BB190B07A7C8EE0A6D709E02FCE1CDF7E2ECC03404CD28342F61" +
+		"9172FE9CE98583FF8E4F1232EEF28183C3FE3B1B4C6FAD733BB5FCBC2EC22005" +
+		"C58EF1837D1683B2C6F34A26C1B2EFFA886B4238611FCFDCDE355B3B6519035B" +
+		"BC34F4DEF99C023861B46FC9D6E6C9077AD91D2691F7F7EE598CB0FAC186D91C" +
+		"AEFE130985139270B4130C93BC437944F4FD4452E2D74DD364F2E21E71F54BFF" +
+		"5CAE82AB9C9DF69EE86D2BC522363A0DABC521979B0DEADA1DBF9A42D5C4484E" +
+		"0ABCD06BFA53DDEF3C1B20EE3FD59D7C25E41D2B669E1EF16E6F52C3164DF4FB" +
+		"7930E9E4E58857B6AC7D5F42D69F6D187763CF1D5503400487F55BA57E31CC7A" +
+		"7135C886EFB4318AED6A1E012D9E6832A907600A918130C46DC778F971AD0038" +
+		"092999A333CB8B7A1A1DB93D7140003C2A4ECEA9F98D0ACC0A8291CDCEC97DCF" +
+		"8EC9B55A7F88A46B4DB5A851F44182E1C68A007E5E655F6AFFFFFFFFFFFFFFFF"
+	rfc3526Group14 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74" +
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437" +
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05" +
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB" +
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718" +
+		"3995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF"
+	rfc3526Group15 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74" +
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437" +
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05" +
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB" +
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718" +
+		"3995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33" +
+		"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7" +
+		"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864" +
+		"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E2" +
+		"08E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF"
+	rfc3526Group16 = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74" +
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437" +
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05" +
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB" +
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718" +
+		"3995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33" +
+		"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7" +
+		"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864" +
+		"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E2" +
+		"08E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D7" +
+		"88719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8" +
+		"DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2" +
+		"233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA9" +
+		"93B4EA988D8FDDC186FFB7DC90A6C08F4DF435C934063199FFFFFFFFFFFFFFFF"
+)
+
+var bigTwo = big.NewInt(2)
+
+var dhGroups = sync.OnceValue(func() map[DHGroup]*big.Int {
+	return map[DHGroup]*big.Int{
+		DHGroupDefault:   mustParseDHPrime(rfc7919FFDHE2048),
+		DHGroupFFDHE2048: mustParseDHPrime(rfc7919FFDHE2048),
+		DHGroupFFDHE3072: mustParseDHPrime(rfc7919FFDHE3072),
+		DHGroupFFDHE4096: mustParseDHPrime(rfc7919FFDHE4096),
+		DHGroupMODP2048:  mustParseDHPrime(rfc3526Group14),
+		DHGroupMODP3072:  mustParseDHPrime(rfc3526Group15),
+		DHGroupMODP4096:  mustParseDHPrime(rfc3526Group16),
+	}
+})
+
+func mustParseDHPrime(s string) *big.Int {
+	p, ok := new(big.Int).SetString(s, 16)
+
+	if !ok {
+		panic("nrpe: invalid dh prime")
+	}
+
+	return p
+}
+
+// dhParams are DH parameters in PKCS #3 form
+type dhParams struct {
+	P *big.Int
+	G *big.Int
+	// PrivateValueLength is optional and ignored
+	PrivateValueLength int `asn1:"optional"`
+}
+
+// getDHParams returns DH parameters of the config, loading them on first use
+func getDHParams(config *SSLConfig) (*dhParams, error) {
+	params, err := config.context(sslContextKey{"dh", true}, func() (interface{}, error) {
+		return loadDHParams(config)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return params.(*dhParams), nil
+}
+
+func loadDHParams(config *SSLConfig) (*dhParams, error) {
+	if config.DHParamsFile == "" {
+		p, ok := dhGroups()[config.DHGroup]
+
+		if !ok {
+			return nil, fmt.Errorf("nrpe: unknown DH group %d", config.DHGroup)
+		}
+
+		return &dhParams{P: p, G: bigTwo}, nil
+	}
+
+	data, err := os.ReadFile(config.DHParamsFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("nrpe: cannot load DH parameters: %v", err)
+	}
+
+	params, err := parseDHParams(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("nrpe: cannot load DH parameters from %s: %v", config.DHParamsFile, err)
+	}
+
+	return params, nil
+}
+
+// parseDHParams parses PEM encoded "DH PARAMETERS" block
+// as written by openssl dhparam
+func parseDHParams(data []byte) (*dhParams, error) {
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+
+		if block == nil {
+			return nil, fmt.Errorf("no DH PARAMETERS block found")
+		}
+
+		if block.Type != "DH PARAMETERS" {
+			continue
+		}
+
+		var params dhParams
+
+		if _, err := asn1.Unmarshal(block.Bytes, &params); err != nil {
+			return nil, err
+		}
+
+		if params.P.BitLen() < minDHBits {
+			return nil, fmt.Errorf("DH prime is too small: %d bits, at least %d required",
+				params.P.BitLen(), minDHBits)
+		}
+
+		if !dhPublicValueValid(params.P, params.G) {
+			return nil, fmt.Errorf("invalid DH generator")
+		}
+
+		return &params, nil
+	}
+}
+
+// dhPublicValueValid checks that 1 < v < p-1
+func dhPublicValueValid(p, v *big.Int) bool {
+	limit := new(big.Int).Sub(p, big.NewInt(1))
+
+	return v.Cmp(big.NewInt(1)) > 0 && v.Cmp(limit) < 0
+}
+
+// pem encodes parameters the way openssl dhparam does
+func (p *dhParams) pem() []byte {
+	der, err := asn1.Marshal(struct{ P, G *big.Int }{p.P, p.G})
+
+	if err != nil {
+		panic(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "DH PARAMETERS", Bytes: der})
+}
@@ -0,0 +1,86 @@
+package nrpe
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDHGroups(t *testing.T) {
+	bits := map[DHGroup]int{
+		DHGroupDefault:   2048,
+		DHGroupFFDHE2048: 2048,
+		DHGroupFFDHE3072: 3072,
+		DHGroupFFDHE4096: 4096,
+		DHGroupMODP2048:  2048,
+		DHGroupMODP3072:  3072,
+		DHGroupMODP4096:  4096,
+	}
+
+	for group, n := range bits {
+		params, err := loadDHParams(&SSLConfig{DHGroup: group})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := new(big.Int).Rsh(params.P, 1)
+
+		if params.P.BitLen() != n || !params.P.ProbablyPrime(2) || !q.ProbablyPrime(2) {
+			t.Fatalf("Expected %d-bit safe prime for group %d", n, group)
+		}
+	}
+
+	if _, err := loadDHParams(&SSLConfig{DHGroup: DHGroup(100)}); err == nil {
+		t.Fatal("Expected unknown group error")
+	}
+}
+
+func TestDHParamsFile(t *testing.T) {
+	dir := t.TempDir()
+
+	expected := &dhParams{P: mustParseDHPrime(rfc3526Group15), G: bigTwo}
+
+	// parameters are preceded by unrelated block
+	data := "-----BEGIN FOO-----\nAAAA\n-----END FOO-----\n" + string(expected.pem())
+
+	path := filepath.Join(dir, "dh.pem")
+
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := loadDHParams(&SSLConfig{DHParamsFile: path, DHGroup: DHGroupFFDHE4096})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if params.P.Cmp(expected.P) != 0 || params.G.Cmp(expected.G) != 0 {
+		t.Fatal("Unexpected parameters")
+	}
+
+	if _, err = loadDHParams(&SSLConfig{DHParamsFile: filepath.Join(dir, "missing.pem")}); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestParseDHParamsErrors(t *testing.T) {
+	small := &dhParams{P: big.NewInt(23), G: bigTwo}
+	badGenerator := &dhParams{P: mustParseDHPrime(rfc7919FFDHE2048), G: big.NewInt(1)}
+
+	tests := map[string]string{
+		"":                         "no DH PARAMETERS block",
+		string(small.pem()):        "too small",
+		string(badGenerator.pem()): "invalid DH generator",
+		"-----BEGIN DH PARAMETERS-----\nAAAA\n-----END DH PARAMETERS-----\n": "asn1",
+	}
+
+	for data, message := range tests {
+		if _, err := parseDHParams([]byte(data)); err == nil || !strings.Contains(err.Error(), message) {
+			t.Fatalf("Expected %q error, got %v", message, err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !cgo && !nrpe_purego
+// +build !cgo,!nrpe_purego
+
+package nrpe
+
+import (
+	"net"
+)
+
+// Without cgo OpenSSL isn't available, only plain connections
+// are supported unless the package is built with the nrpe_purego tag.
+
+func newSSLClient(conn net.Conn, config *SSLConfig) (sslConnection, error) {
+	return nil, ErrSSLUnsupported
+}
+
+func newSSLServerConn(conn net.Conn, config *SSLConfig) (sslConnection, error) {
+	return nil, ErrSSLUnsupported
+}
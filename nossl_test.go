@@ -0,0 +1,43 @@
+//go:build !cgo && !nrpe_purego
+// +build !cgo,!nrpe_purego
+
+package nrpe
+
+import (
+	"testing"
+)
+
+func TestClientSSLUnsupported(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	_, err := Run(sock.client, NewCommand("check_something"), true, 0)
+
+	if err != ErrSSLUnsupported {
+		t.Fatal("Expected ErrSSLUnsupported")
+	}
+}
+
+func TestServerSSLUnsupported(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	err := ServeOne(sock.server, nil, true, 0)
+
+	if err != ErrSSLUnsupported {
+		t.Fatal("Expected ErrSSLUnsupported")
+	}
+}
+
+func TestSSLConnUnsupported(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	if _, err := NewSSLClient(sock.client, nil); err != ErrSSLUnsupported {
+		t.Fatal("Expected ErrSSLUnsupported")
+	}
+
+	if _, err := NewSSLServer(sock.server, nil); err != ErrSSLUnsupported {
+		t.Fatal("Expected ErrSSLUnsupported")
+	}
+}
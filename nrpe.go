@@ -8,19 +8,19 @@ package nrpe
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"math/rand"
 	"net"
 	"strings"
+	"sync"
 	"time"
-	"unsafe"
 )
 
-var crc32Table []uint32
-
-var randSource *rand.Rand
-
 const (
 	maxPacketDataLength = 1024
 	packetLength        = maxPacketDataLength + 12
@@ -36,6 +36,10 @@ const (
 	nrpePacketVersion2 = 2
 )
 
+// ErrSSLUnsupported is returned for ssl connections when the package
+// is built without cgo and without the nrpe_purego tag
+var ErrSSLUnsupported = errors.New("nrpe: ssl is not supported in this build")
+
 // Result status codes
 const (
 	StatusOK       = 0
@@ -51,6 +55,23 @@ type CommandStatus int
 type CommandResult struct {
 	StatusLine string
 	StatusCode CommandStatus
+	// SSL describes the connection the result was received over,
+	// it is nil for plain connections
+	SSL *ConnectionState
+	// Address is the address dialed by Client.Check
+	Address string
+	// RemoteAddr is the address of the server which answered
+	RemoteAddr net.Addr
+	// ProtocolVersion is nrpe packet version of the response
+	ProtocolVersion int
+	// Truncated is set if the status line hit the payload limit
+	Truncated bool
+	// ConnectDuration is time spent connecting, set by Client.Check only
+	ConnectDuration time.Duration
+	// HandshakeDuration is time of the ssl handshake, zero for plain connections
+	HandshakeDuration time.Duration
+	// RoundTripDuration is time from sending the request to reading the response
+	RoundTripDuration time.Duration
 }
 
 type packet struct {
@@ -62,61 +83,62 @@ type packet struct {
 	data          []byte
 
 	all []byte
+	buf [packetLength]byte
 }
 
-// Initialization of crc32Table and randSource
-func init() {
-	var crc, poly, i, j uint32
-
-	crc32Table = make([]uint32, 256)
-
-	poly = uint32(0xEDB88320)
-
-	for i = 0; i < 256; i++ {
-		crc = i
-
-		for j = 8; j > 0; j-- {
-			if (crc & 1) != 0 {
-				crc = (crc >> 1) ^ poly
-			} else {
-				crc >>= 1
-			}
-		}
+// packetPool recycles packets, they are put back once the content
+// is written or copied out
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return createPacket()
+	},
+}
 
-		crc32Table[i] = crc
-	}
+func getPacket() *packet {
+	return packetPool.Get().(*packet)
+}
 
-	randSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+func putPacket(p *packet) {
+	packetPool.Put(p)
 }
 
-//Builds crc32 from the given input
-func crc32(in []byte) uint32 {
-	var crc uint32
+// pseudoRand reads from the goroutine safe top-level math/rand source
+type pseudoRand struct{}
 
-	crc = uint32(0xFFFFFFFF)
+func (pseudoRand) Read(b []byte) (int, error) {
+	var buf [8]byte
 
-	for _, c := range in {
-		crc = ((crc >> 8) & uint32(0x00FFFFFF)) ^ crc32Table[(crc^uint32(c))&0xFF]
+	for i := 0; i < len(b); i += 8 {
+		binary.LittleEndian.PutUint64(buf[:], rand.Uint64())
+		copy(b[i:], buf[:])
 	}
 
-	return (crc ^ uint32(0xFFFFFFFF))
+	return len(b), nil
 }
 
-//extra randomization for encryption
-func randomizeBuffer(in []byte) {
-	n := len(in) >> 2
-
-	for i := 0; i < n; i++ {
-		r := randSource.Uint32()
+//extra randomization for encryption, pseudoRand is used if random is nil
+func randomizeBuffer(in []byte, random io.Reader) error {
+	if random == nil {
+		random = pseudoRand{}
+	}
 
-		copy(in[i<<2:(i+1)<<2], (*[4]byte)(unsafe.Pointer(&r))[:])
+	if _, err := io.ReadFull(random, in); err != nil {
+		return fmt.Errorf("nrpe: error while reading random source: %v", err)
 	}
 
-	if len(in)%4 != 0 {
-		r := randSource.Uint32()
+	return nil
+}
 
-		copy(in[n<<2:], (*[4]byte)(unsafe.Pointer(&r))[:len(in)-(n<<2)])
-	}
+// sslConnection is implemented by the ssl connection wrappers
+type sslConnection interface {
+	net.Conn
+	// Clean releases ssl resources without closing underlying connection
+	Clean()
+	// Handshake runs the handshake unless it's already done,
+	// Read and Write call it implicitly
+	Handshake(ctx context.Context) error
+	// sslState returns state of the established connection
+	sslState() *ConnectionState
 }
 
 // Command represents command name and argument list
@@ -144,8 +166,8 @@ func (c Command) toStatusLine() string {
 }
 
 func createPacket() *packet {
-	var p packet
-	p.all = make([]byte, packetLength)
+	p := new(packet)
+	p.all = p.buf[:]
 
 	p.packetVersion = p.all[0:2]
 	p.packetType = p.all[2:4]
@@ -153,7 +175,7 @@ func createPacket() *packet {
 	p.statusCode = p.all[8:10]
 	p.data = p.all[10 : packetLength-2]
 
-	return &p
+	return p
 }
 
 // verifyPacket checks packetType and crc32
@@ -171,7 +193,7 @@ func verifyPacket(responsePacket *packet, packetType uint16) error {
 
 	be.PutUint32(responsePacket.crc32, 0)
 
-	if crc != crc32(responsePacket.all) {
+	if crc != crc32.ChecksumIEEE(responsePacket.all) {
 		return fmt.Errorf("nrpe: Response crc didn't match")
 	}
 	return nil
@@ -185,9 +207,13 @@ func readCommandResult(p *packet) (*CommandResult, error) {
 	pos := bytes.IndexByte(p.data, 0)
 
 	if pos != -1 {
-		result.StatusLine = string(p.data[:pos])
+		result.StatusLine = normalizeOutput(string(p.data[:pos]))
 	}
 
+	// the server cuts the output to fit terminating zero
+	result.Truncated = pos == -1 || pos == maxPacketDataLength-1
+	result.ProtocolVersion = int(be.Uint16(p.packetVersion))
+
 	code := be.Uint16(p.statusCode)
 
 	switch code {
@@ -200,13 +226,17 @@ func readCommandResult(p *packet) (*CommandResult, error) {
 	return &result, nil
 }
 
-// buildPacket creates packet structure
-func buildPacket(packetType uint16, statusCode uint16, statusLine []byte) *packet {
+// buildPacket creates packet structure padded from random,
+// the packet comes from packetPool
+func buildPacket(packetType uint16, statusCode uint16, statusLine string, random io.Reader) (*packet, error) {
 	be := binary.BigEndian
 
-	p := createPacket()
+	p := getPacket()
 
-	randomizeBuffer(p.all)
+	if err := randomizeBuffer(p.all, random); err != nil {
+		putPacket(p)
+		return nil, err
+	}
 
 	be.PutUint16(p.packetVersion, nrpePacketVersion2)
 	be.PutUint16(p.packetType, packetType)
@@ -221,9 +251,9 @@ func buildPacket(packetType uint16, statusCode uint16, statusLine []byte) *packe
 	copy(p.data, statusLine[:length])
 	p.data[length] = 0
 
-	be.PutUint32(p.crc32, crc32(p.all))
+	be.PutUint32(p.crc32, crc32.ChecksumIEEE(p.all))
 
-	return p
+	return p, nil
 }
 
 // writePacket writes packet content to connection
@@ -245,6 +275,31 @@ func writePacket(conn net.Conn, timeout time.Duration, p *packet) error {
 	return nil
 }
 
+// orTimeout returns timeout, or fallback if timeout is zero
+func orTimeout(timeout, fallback time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+
+	return fallback
+}
+
+// sslHandshake runs the handshake of conn limited by timeout,
+// the deadline is cleared afterwards, so it doesn't limit the request
+func sslHandshake(ctx context.Context, conn sslConnection, timeout time.Duration) error {
+	if timeout <= 0 {
+		return conn.Handshake(ctx)
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := conn.Handshake(ctx); err != nil {
+		return err
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
 // readPacket reads from connection to packet
 func readPacket(conn net.Conn, timeout time.Duration, p *packet) error {
 	if timeout > 0 {
@@ -264,100 +319,128 @@ func readPacket(conn net.Conn, timeout time.Duration, p *packet) error {
 	return nil
 }
 
-// Run specified command
-func Run(conn net.Conn, command Command, isSSL bool,
-	timeout time.Duration) (*CommandResult, error) {
+// aLongTimeAgo is a deadline which interrupts blocked operations
+var aLongTimeAgo = time.Unix(1, 0)
 
-	var err error
-
-	// setup ssl connection
-	if isSSL {
-		conn, err = newSSLClient(conn)
-		if err != nil {
-			return nil, err
-		}
-		defer conn.(*sslConn).Clean()
+// handshakeContext runs handshake interrupting it by setting
+// deadline of conn in the past once ctx is done
+func handshakeContext(ctx context.Context, conn net.Conn, handshake func() error) error {
+	if ctx.Done() == nil {
+		return handshake()
 	}
 
-	statusLine := command.toStatusLine()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
 
-	if len(statusLine) >= maxPacketDataLength {
-		return nil, fmt.Errorf("nrpe: Command is too long: got %d, max allowed %d",
-			len(statusLine), maxPacketDataLength-1)
-	}
+	err := handshake()
 
-	request := buildPacket(queryPacketType, 0, []byte(statusLine))
-
-	if err = writePacket(conn, timeout, request); err != nil {
-		return nil, err
+	if !stop() && err != nil {
+		return ctx.Err()
 	}
 
-	response := createPacket()
+	return err
+}
 
-	if err = readPacket(conn, timeout, response); err != nil {
-		return nil, err
+// contextError returns error of ctx once it's done or its deadline
+// has passed, as the connection deadline may fire before ctx is done
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	if err = verifyPacket(response, responsePacketType); err != nil {
-		return nil, err
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
 	}
 
-	var result *CommandResult
-
-	if result, err = readCommandResult(response); err != nil {
-		return nil, err
-	}
+	return nil
+}
 
-	return result, nil
+// contextConn limits io deadlines of the connection
+// by the deadline and cancellation of the context
+type contextConn struct {
+	net.Conn
+	ctx  context.Context
+	lock sync.Mutex
+	stop func() bool
 }
 
-// ServeOne function will handle one request. After receiving request
-// it will call handler callback function and the result of callback
-// will be sent to requester.
-func ServeOne(conn net.Conn, handler func(Command) (*CommandResult, error),
-	isSSL bool, timeout time.Duration) error {
+func newContextConn(ctx context.Context, conn net.Conn) *contextConn {
+	c := &contextConn{Conn: conn, ctx: ctx}
 
-	var err error
+	c.SetDeadline(time.Time{})
 
-	// setup ssl
-	if isSSL {
-		conn, err = newSSLServerConn(conn)
-		if err != nil {
-			return err
-		}
-		defer conn.(*sslConn).Clean()
-	}
+	c.stop = context.AfterFunc(ctx, func() {
+		c.lock.Lock()
+		c.Conn.SetDeadline(aLongTimeAgo)
+		c.lock.Unlock()
+	})
 
-	request := createPacket()
+	return c
+}
 
-	if err = readPacket(conn, timeout, request); err != nil {
-		return err
+func (c *contextConn) limit(t time.Time) time.Time {
+	if c.ctx.Err() != nil {
+		return aLongTimeAgo
 	}
 
-	if err = verifyPacket(request, queryPacketType); err != nil {
-		return err
+	if d, ok := c.ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+		return d
 	}
 
-	var pos = bytes.IndexByte(request.data, 0)
+	return t
+}
 
-	if pos == -1 {
-		return fmt.Errorf("nrpe: invalid request")
-	}
+func (c *contextConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	data := strings.Split(string(request.data[:pos]), "!")
+	return c.Conn.SetDeadline(c.limit(t))
+}
 
-	result, err := handler(NewCommand(data[0], data[1:]...))
+func (c *contextConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	if err != nil {
-		return err
+	return c.Conn.SetReadDeadline(c.limit(t))
+}
+
+func (c *contextConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.Conn.SetWriteDeadline(c.limit(t))
+}
+
+// Run specified command
+func Run(conn net.Conn, command Command, isSSL bool,
+	timeout time.Duration) (*CommandResult, error) {
+
+	client := Client{Timeout: timeout}
+
+	if isSSL {
+		client.SSL = anonymousSSLConfig
 	}
 
-	response := buildPacket(responsePacketType,
-		uint16(result.StatusCode), []byte(result.StatusLine))
+	return client.Run(context.Background(), conn, command)
+}
+
+// ServeOne function will handle one request. After receiving request
+// it will call handler callback function and the result of callback
+// will be sent to requester.
+func ServeOne(conn net.Conn, handler func(Command) (*CommandResult, error),
+	isSSL bool, timeout time.Duration) error {
 
-	if err = writePacket(conn, timeout, response); err != nil {
-		return err
+	server := Server{
+		Handler: func(_ context.Context, command Command) (*CommandResult, error) {
+			return handler(command)
+		},
+		Timeout: timeout,
 	}
 
-	return nil
+	if isSSL {
+		server.SSL = anonymousSSLConfig
+	}
+
+	return server.ServeOne(context.Background(), conn)
 }
@@ -7,13 +7,25 @@ import (
 	"syscall"
 
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"math/rand"
 	"strings"
+	"sync"
 	"testing"
 	"time"
-	"unsafe"
 
 	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"path/filepath"
 )
 
 func ExampleRun() {
@@ -89,6 +101,100 @@ func testCreateSocketPair(t *testing.T) *testSocketPair {
 	return s
 }
 
+// testRequireSSL skips the test in builds without ssl support
+func testRequireSSL(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	ssl, err := newSSLClient(sock.client, nil)
+
+	if err == ErrSSLUnsupported {
+		t.Skip("ssl isn't supported by this build")
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ssl.Clean()
+}
+
+type testCertificates struct {
+	ca, otherCA           string
+	serverCert, serverKey string
+	clientCert, clientKey string
+}
+
+func testWritePEM(t *testing.T, path, blockType string, data []byte) string {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// testIssueCertificate creates certificate signed by parent,
+// self-signed one if parent is nil
+func testIssueCertificate(t *testing.T, dir, name string, parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, template, parent, &key.PublicKey, parentKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testWritePEM(t, filepath.Join(dir, name+".crt"), "CERTIFICATE", der),
+		testWritePEM(t, filepath.Join(dir, name+".key"), "PRIVATE KEY", keyDer),
+		cert, key
+}
+
+func testCreateCertificates(t *testing.T) *testCertificates {
+	dir := t.TempDir()
+
+	var certs testCertificates
+
+	var ca *x509.Certificate
+	var caKey *ecdsa.PrivateKey
+
+	certs.ca, _, ca, caKey = testIssueCertificate(t, dir, "ca", nil, nil)
+	certs.otherCA, _, _, _ = testIssueCertificate(t, dir, "other", nil, nil)
+	certs.serverCert, certs.serverKey, _, _ = testIssueCertificate(t, dir, "server", ca, caKey)
+	certs.clientCert, certs.clientKey, _, _ = testIssueCertificate(t, dir, "client", ca, caKey)
+
+	return &certs
+}
+
 func TestClientServer(t *testing.T) {
 
 	sock := testCreateSocketPair(t)
@@ -104,7 +210,7 @@ func TestClientServer(t *testing.T) {
 		}, false, 0)
 
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 
 		c <- 1
@@ -139,7 +245,7 @@ func TestClientServerTimeoutOk(t *testing.T) {
 		}, false, 0)
 
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 
 		c <- 1
@@ -175,7 +281,7 @@ func TestClientServerTimeoutServer(t *testing.T) {
 		}, false, 10)
 
 		if err == nil {
-			t.Fatal("Expected timeout")
+			t.Error("Expected timeout")
 		}
 
 		c <- 1
@@ -206,7 +312,7 @@ func TestClientServerTimeoutClient(t *testing.T) {
 		}, false, 1)
 
 		if err == nil {
-			t.Fatal("Expected timeout")
+			t.Error("Expected timeout")
 		}
 
 		c <- 1
@@ -217,27 +323,206 @@ func TestClientServerTimeoutClient(t *testing.T) {
 	<-c
 }
 
-func TestBufferRandomizer(t *testing.T) {
-	randSource.Seed(0)
+// testIsTimeout reports whether err is a network timeout
+func testIsTimeout(err error) bool {
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestClientReadTimeout(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	// the server reads the request but never responds
+	go sock.server.Read(make([]byte, packetLength))
+
+	client := Client{Timeout: time.Minute, ReadTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+
+	if _, err := client.Run(context.Background(), sock.client, NewCommand("check")); !testIsTimeout(err) {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("Read timeout wasn't used")
+	}
+}
+
+func TestClientCheckTimeout(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	go sock.server.Read(make([]byte, packetLength))
+
+	client := Client{CheckTimeout: 50 * time.Millisecond}
+
+	if _, err := client.Run(context.Background(), sock.client, NewCommand("check")); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error, got %v", err)
+	}
+}
+
+func TestClientConnectTimeout(t *testing.T) {
+	client := Client{Timeout: time.Minute, ConnectTimeout: 50 * time.Millisecond}
+
+	client.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("Expected dial deadline")
+		}
+
+		<-ctx.Done()
+
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	}
 
+	if _, err := client.Check(context.Background(), "unreachable", NewCommand("check")); err == nil {
+		t.Fatal("Expected connect error")
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	server := Server{
+		Handler: func(ctx context.Context, command Command) (*CommandResult, error) {
+			return &CommandResult{StatusLine: "OK", StatusCode: StatusOK}, nil
+		},
+		Timeout:     time.Minute,
+		ReadTimeout: 50 * time.Millisecond,
+	}
+
+	// the client never sends the request
+	if err := server.ServeOne(context.Background(), sock.server); !testIsTimeout(err) {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+}
+
+func TestClientServerMetadata(t *testing.T) {
+	for _, length := range []int{10, maxPacketDataLength - 2, maxPacketDataLength - 1, 2 * maxPacketDataLength} {
+		sock := testCreateSocketPair(t)
+		defer sock.Close()
+
+		server := Server{
+			Handler: func(ctx context.Context, command Command) (*CommandResult, error) {
+				info := RequestInfoFromContext(ctx)
+
+				if info == nil || info.ProtocolVersion != nrpePacketVersion2 || info.HandshakeDuration != 0 {
+					t.Errorf("Unexpected request info %+v", info)
+				}
+
+				return &CommandResult{StatusLine: strings.Repeat("x", length), StatusCode: StatusOK}, nil
+			},
+		}
+
+		c := make(chan error)
+
+		go func() {
+			c <- server.ServeOne(context.Background(), sock.server)
+		}()
+
+		result, err := (&Client{}).Run(context.Background(), sock.client, NewCommand("check"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = <-c; err != nil {
+			t.Fatal(err)
+		}
+
+		if result.Truncated != (length >= maxPacketDataLength-1) {
+			t.Fatalf("Unexpected truncation %v of %d bytes", result.Truncated, length)
+		}
+
+		if result.ProtocolVersion != nrpePacketVersion2 || result.RemoteAddr == nil ||
+			result.RoundTripDuration <= 0 || result.HandshakeDuration != 0 || result.ConnectDuration != 0 {
+			t.Fatalf("Unexpected metadata %+v", result)
+		}
+	}
+}
+
+// testBuildPacket builds packet with the default padding source, which doesn't fail
+func testBuildPacket(packetType uint16, statusCode uint16, statusLine string) *packet {
+	p, err := buildPacket(packetType, statusCode, statusLine, nil)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+func TestBufferRandomizer(t *testing.T) {
 	randExpected := make([]byte, 8)
 
-	r := randSource.Uint32()
-	copy(randExpected[:4], (*[4]byte)(unsafe.Pointer(&r))[:])
-	r = randSource.Uint32()
-	copy(randExpected[4:], (*[4]byte)(unsafe.Pointer(&r))[:])
+	rand.New(rand.NewSource(0)).Read(randExpected)
 
 	for i := 0; i < len(randExpected); i++ {
-		randSource.Seed(0)
-
 		buf := make([]byte, i)
 
-		randomizeBuffer(buf)
+		if err := randomizeBuffer(buf, rand.New(rand.NewSource(0))); err != nil {
+			t.Fatal(err)
+		}
 
 		if !bytes.Equal(buf, randExpected[:i]) {
 			t.Fatal("Rand result didn't match")
 		}
 	}
+
+	if err := randomizeBuffer(make([]byte, 8), bytes.NewReader(nil)); err == nil {
+		t.Fatal("Expected error for exhausted source")
+	}
+}
+
+func TestBuildPacketDeterministic(t *testing.T) {
+	a, err := buildPacket(queryPacketType, 0, "test", rand.New(rand.NewSource(1)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := buildPacket(queryPacketType, 0, "test", rand.New(rand.NewSource(1)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a.all, b.all) {
+		t.Fatal("Expected equal packets for equal seeds")
+	}
+
+	if _, err = buildPacket(queryPacketType, 0, "test", bytes.NewReader(nil)); err == nil {
+		t.Fatal("Expected error for exhausted source")
+	}
+}
+
+func TestClientServerConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sock := testCreateSocketPair(t)
+			defer sock.Close()
+
+			go ServeOne(sock.server, func(command Command) (*CommandResult, error) {
+				return &CommandResult{StatusLine: "OK", StatusCode: StatusOK}, nil
+			}, false, 0)
+
+			client := Client{Rand: crand.Reader}
+
+			if _, err := client.Run(context.Background(), sock.client, NewCommand("check")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
 }
 
 func TestCommandToStatusLine(t *testing.T) {
@@ -314,7 +599,7 @@ func TestClientVerifyTypeError(t *testing.T) {
 	clientSock := &testConn{Conn: sock.client}
 
 	clientSock.read = func(b []byte) (n int, err error) {
-		p := buildPacket(queryPacketType, 0, []byte("test"))
+		p := testBuildPacket(queryPacketType, 0, "test")
 		copy(b, p.all)
 		return len(p.all), nil
 	}
@@ -334,7 +619,7 @@ func TestClientVerifyCrcError(t *testing.T) {
 	clientSock := &testConn{Conn: sock.client}
 
 	clientSock.read = func(b []byte) (n int, err error) {
-		p := buildPacket(responsePacketType, 0, []byte("test"))
+		p := testBuildPacket(responsePacketType, 0, "test")
 
 		p.crc32[0] = 0
 
@@ -358,7 +643,7 @@ func TestClientStatusError(t *testing.T) {
 	clientSock := &testConn{Conn: sock.client}
 
 	clientSock.read = func(b []byte) (n int, err error) {
-		p := buildPacket(responsePacketType, 10, []byte("test"))
+		p := testBuildPacket(responsePacketType, 10, "test")
 
 		copy(b, p.all)
 
@@ -393,7 +678,7 @@ func TestPacketTruncation(t *testing.T) {
 		statusLine[i] = byte(i & 0xFF)
 	}
 
-	packet := buildPacket(0, 0, statusLine)
+	packet := testBuildPacket(0, 0, string(statusLine))
 
 	statusLine[len(packet.data)-1] = 0
 
@@ -450,7 +735,7 @@ func TestServerVerifyTypeError(t *testing.T) {
 	serverSock := &testConn{Conn: sock.client}
 
 	serverSock.read = func(b []byte) (n int, err error) {
-		p := buildPacket(responsePacketType, 0, []byte("test"))
+		p := testBuildPacket(responsePacketType, 0, "test")
 		copy(b, p.all)
 		return len(p.all), nil
 	}
@@ -468,7 +753,7 @@ func TestServerVerifyCrcError(t *testing.T) {
 	serverSock := &testConn{Conn: sock.client}
 
 	serverSock.read = func(b []byte) (n int, err error) {
-		p := buildPacket(queryPacketType, 0, []byte("test"))
+		p := testBuildPacket(queryPacketType, 0, "test")
 
 		p.crc32[0] = 0
 
@@ -500,7 +785,7 @@ func TestServerInvalidRespone(t *testing.T) {
 		be.PutUint16(p.statusCode, 0)
 
 		copy(p.data, bytes.Repeat([]byte("A"), len(p.data)))
-		be.PutUint32(p.crc32, crc32(p.all))
+		be.PutUint32(p.crc32, crc32.ChecksumIEEE(p.all))
 
 		copy(b, p.all)
 
@@ -520,7 +805,7 @@ func TestServerHandlerError(t *testing.T) {
 	serverSock := &testConn{Conn: sock.client}
 
 	serverSock.read = func(b []byte) (n int, err error) {
-		p := buildPacket(queryPacketType, 0, []byte("test"))
+		p := testBuildPacket(queryPacketType, 0, "test")
 
 		copy(b, p.all)
 
@@ -542,7 +827,7 @@ func TestServerWriteError(t *testing.T) {
 	serverSock := &testConn{Conn: sock.client}
 
 	serverSock.read = func(b []byte) (n int, err error) {
-		p := buildPacket(queryPacketType, 0, []byte("test"))
+		p := testBuildPacket(queryPacketType, 0, "test")
 
 		copy(b, p.all)
 
@@ -564,3 +849,21 @@ func TestServerWriteError(t *testing.T) {
 		t.Fatal("Expecting error")
 	}
 }
+
+func TestParseSSLPolicy(t *testing.T) {
+	for name, expected := range map[string]SSLPolicy{
+		"ssl":        SSLPolicySSL,
+		"plain":      SSLPolicyPlain,
+		"prefer-ssl": SSLPolicyPreferSSL,
+	} {
+		policy, err := ParseSSLPolicy(name)
+
+		if err != nil || policy != expected {
+			t.Fatalf("Unexpected policy %v for %q: %v", policy, name, err)
+		}
+	}
+
+	if _, err := ParseSSLPolicy("tls"); err == nil {
+		t.Fatal("Expected error for unknown policy")
+	}
+}
@@ -0,0 +1,115 @@
+package nrpe
+
+import (
+	"strings"
+)
+
+// PluginOutput represents status line in the nagios plugin output format:
+//
+//	TEXT OUTPUT | OPTIONAL PERFDATA
+//	LONG TEXT LINE 1
+//	LONG TEXT LINE 2 | PERFDATA LINE 2
+//	PERFDATA LINE 3
+type PluginOutput struct {
+	// Text is the first line of the output without performance data
+	Text string
+	// LongText holds the following lines, separated by new lines
+	LongText string
+	// PerfData combines performance data from all the lines
+	PerfData []PerfData
+}
+
+// normalizeOutput converts line endings to '\n' and removes trailing
+// new lines, so that client and server treat multi-line output the same
+func normalizeOutput(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+
+	return strings.TrimRight(s, "\n")
+}
+
+// splitPluginOutput splits output into text, long text and raw perfdata
+func splitPluginOutput(s string) (string, string, string) {
+	lines := strings.Split(normalizeOutput(s), "\n")
+
+	var text string
+	var long, perf []string
+
+	if pos := strings.IndexByte(lines[0], '|'); pos != -1 {
+		text = lines[0][:pos]
+		perf = append(perf, lines[0][pos+1:])
+	} else {
+		text = lines[0]
+	}
+
+	lines = lines[1:]
+
+	for i, line := range lines {
+		pos := strings.IndexByte(line, '|')
+
+		if pos == -1 {
+			long = append(long, line)
+			continue
+		}
+
+		long = append(long, line[:pos])
+		perf = append(perf, line[pos+1:])
+		perf = append(perf, lines[i+1:]...)
+
+		break
+	}
+
+	return strings.TrimSpace(text),
+		strings.TrimSpace(strings.Join(long, "\n")),
+		strings.Join(perf, " ")
+}
+
+// ParsePluginOutput parses multi-line plugin output
+func ParsePluginOutput(s string) (*PluginOutput, error) {
+	text, long, perf := splitPluginOutput(s)
+
+	perfData, err := ParsePerfData(perf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &PluginOutput{
+		Text:     text,
+		LongText: long,
+		PerfData: perfData,
+	}, nil
+}
+
+// String formats output, placing performance data on the first line
+func (o PluginOutput) String() string {
+	s := FormatStatusLine(o.Text, o.PerfData...)
+
+	if o.LongText != "" {
+		s += "\n" + removePipes(normalizeOutput(o.LongText))
+	}
+
+	return s
+}
+
+// Output parses status line of the result as plugin output
+func (r CommandResult) Output() (*PluginOutput, error) {
+	return ParsePluginOutput(r.StatusLine)
+}
+
+// ShortText returns the first line of the output without performance data
+func (r CommandResult) ShortText() string {
+	text, _, _ := splitPluginOutput(r.StatusLine)
+	return text
+}
+
+// LongText returns the output lines following the first one
+func (r CommandResult) LongText() string {
+	_, long, _ := splitPluginOutput(r.StatusLine)
+	return long
+}
+
+// PerfData returns performance data combined from all the output lines
+func (r CommandResult) PerfData() ([]PerfData, error) {
+	_, _, perf := splitPluginOutput(r.StatusLine)
+	return ParsePerfData(perf)
+}
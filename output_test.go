@@ -0,0 +1,119 @@
+package nrpe
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMultiLineOutput = "DISK OK - free space: / 3326 MB (56%); | /=2643MB;5948;5958;0;5968\r\n" +
+	"/ 15272 MB (77%);\r\n" +
+	"/boot 68 MB (69%); | /boot=68MB;88;93;0;98\r\n" +
+	"/home=69357MB;253404;253409;0;253414\r\n"
+
+func TestParsePluginOutput(t *testing.T) {
+	output, err := ParsePluginOutput(testMultiLineOutput)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output.Text != "DISK OK - free space: / 3326 MB (56%);" {
+		t.Fatalf("Unexpected text %q", output.Text)
+	}
+
+	if output.LongText != "/ 15272 MB (77%);\n/boot 68 MB (69%);" {
+		t.Fatalf("Unexpected long text %q", output.LongText)
+	}
+
+	if len(output.PerfData) != 3 ||
+		output.PerfData[0].Label != "/" ||
+		output.PerfData[1].Label != "/boot" ||
+		output.PerfData[2].Label != "/home" {
+
+		t.Fatal("Unexpected perfdata")
+	}
+}
+
+func TestPluginOutputString(t *testing.T) {
+	output := PluginOutput{
+		Text:     "OK | all good",
+		LongText: "line 1\r\nline | 2\n",
+		PerfData: []PerfData{{Label: "a", Value: 1}},
+	}
+
+	s := output.String()
+
+	if s != "OK all good | a=1\nline 1\nline 2" {
+		t.Fatalf("Unexpected output %q", s)
+	}
+
+	parsed, err := ParsePluginOutput(s)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.String() != s {
+		t.Fatal("Formatted output didn't survive parsing")
+	}
+}
+
+func TestCommandResultAccessors(t *testing.T) {
+	result := CommandResult{StatusLine: testMultiLineOutput}
+
+	if result.ShortText() != "DISK OK - free space: / 3326 MB (56%);" {
+		t.Fatal("Unexpected short text")
+	}
+
+	if !strings.HasPrefix(result.LongText(), "/ 15272 MB") {
+		t.Fatal("Unexpected long text")
+	}
+
+	perfData, err := result.PerfData()
+
+	if err != nil || len(perfData) != 3 {
+		t.Fatal("Unexpected perfdata")
+	}
+
+	result.StatusLine = "OK | a=b"
+
+	if _, err = result.PerfData(); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	if _, err = result.Output(); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestClientServerMultiLine(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	c := make(chan error)
+
+	go func() {
+		c <- ServeOne(sock.server, func(command Command) (*CommandResult, error) {
+			return &CommandResult{
+				StatusLine: testMultiLineOutput,
+				StatusCode: StatusOK,
+			}, nil
+		}, false, 0)
+	}()
+
+	result, err := Run(sock.client, NewCommand("check_disk"), false, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	if result.StatusLine != normalizeOutput(testMultiLineOutput) ||
+		strings.Contains(result.StatusLine, "\r") {
+
+		t.Fatalf("Unexpected status line %q", result.StatusLine)
+	}
+}
@@ -0,0 +1,323 @@
+package nrpe
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// PerfData represents one performance data entry of plugin output
+// in the 'label'=value[UOM];[warn];[crit];[min];[max] format
+type PerfData struct {
+	Label string
+	Value float64
+	// Undetermined is set if the value was reported as "U"
+	Undetermined bool
+	UOM          string
+	// Warn and Crit hold threshold ranges as they were reported
+	Warn string
+	Crit string
+	// Min and Max are nil if the field is empty
+	Min *float64
+	Max *float64
+}
+
+// ParseStatusLine splits status line into text and performance data.
+// For multi-line output the long text is appended to the first line.
+func ParseStatusLine(statusLine string) (string, []PerfData, error) {
+	output, err := ParsePluginOutput(statusLine)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	text := output.Text
+
+	if output.LongText != "" {
+		text += "\n" + output.LongText
+	}
+
+	return text, output.PerfData, nil
+}
+
+// ParsePerfData parses space separated list of performance data entries
+func ParsePerfData(s string) ([]PerfData, error) {
+	var result []PerfData
+
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+
+		if len(s) == 0 {
+			return result, nil
+		}
+
+		label, rest, err := parsePerfDataLabel(s)
+
+		if err != nil {
+			return nil, err
+		}
+
+		end := strings.IndexAny(rest, " \t\r\n")
+
+		if end == -1 {
+			end = len(rest)
+		}
+
+		p, err := parsePerfDataValues(label, rest[:end])
+
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, *p)
+
+		s = rest[end:]
+	}
+}
+
+// parsePerfDataLabel reads optionally quoted label followed by '='
+func parsePerfDataLabel(s string) (string, string, error) {
+	if s[0] != '\'' {
+		pos := strings.IndexByte(s, '=')
+
+		if pos <= 0 || strings.ContainsAny(s[:pos], " \t\r\n") {
+			return "", "", fmt.Errorf("nrpe: invalid perfdata label in %q", s)
+		}
+
+		return s[:pos], s[pos+1:], nil
+	}
+
+	var label []byte
+
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			label = append(label, s[i])
+			continue
+		}
+
+		// two single quotes stand for a quote inside of the label
+		if i+1 < len(s) && s[i+1] == '\'' {
+			label = append(label, '\'')
+			i++
+			continue
+		}
+
+		if i+1 >= len(s) || s[i+1] != '=' || len(label) == 0 {
+			break
+		}
+
+		return string(label), s[i+2:], nil
+	}
+
+	return "", "", fmt.Errorf("nrpe: invalid perfdata label in %q", s)
+}
+
+// parsePerfDataValues parses value[UOM];[warn];[crit];[min];[max]
+func parsePerfDataValues(label, s string) (*PerfData, error) {
+	p := PerfData{Label: label}
+
+	fields := strings.Split(s, ";")
+
+	if len(fields) > 5 {
+		return nil, fmt.Errorf("nrpe: too many perfdata fields for %q", label)
+	}
+
+	if fields[0] == "U" {
+		p.Undetermined = true
+	} else {
+		n := numberPrefixLength(fields[0])
+
+		if n == 0 {
+			return nil, fmt.Errorf("nrpe: invalid perfdata value for %q", label)
+		}
+
+		v, err := parsePerfDataNumber(fields[0][:n])
+
+		if err != nil {
+			return nil, fmt.Errorf("nrpe: invalid perfdata value for %q", label)
+		}
+
+		p.Value = v
+		p.UOM = fields[0][n:]
+	}
+
+	if len(fields) > 1 {
+		p.Warn = fields[1]
+	}
+
+	if len(fields) > 2 {
+		p.Crit = fields[2]
+	}
+
+	for i, dst := range []**float64{&p.Min, &p.Max} {
+		if len(fields) <= i+3 || fields[i+3] == "" {
+			continue
+		}
+
+		v, err := parsePerfDataNumber(fields[i+3])
+
+		if err != nil {
+			return nil, fmt.Errorf("nrpe: invalid perfdata min/max for %q", label)
+		}
+
+		*dst = &v
+	}
+
+	return &p, nil
+}
+
+// numberPrefixLength returns length of the numeric part of value[UOM]
+func numberPrefixLength(s string) int {
+	i := 0
+
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.' || s[i] == ',') {
+		i++
+	}
+
+	// exponent is only taken if followed by digits, so units are left intact
+	if i+1 < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+
+		if s[j] == '-' || s[j] == '+' {
+			j++
+		}
+
+		if j < len(s) && s[j] >= '0' && s[j] <= '9' {
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			i = j
+		}
+	}
+
+	return i
+}
+
+// parsePerfDataNumber parses number, accepting comma as decimal separator
+// parsePerfDataNumber parses decimal number, NaN and infinities
+// which strconv accepts aren't numbers of the format
+func parsePerfDataNumber(s string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+
+	if err == nil && (math.IsNaN(n) || math.IsInf(n, 0)) {
+		return 0, fmt.Errorf("nrpe: invalid number %q", s)
+	}
+
+	return n, err
+}
+
+func formatPerfDataNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// cleanPerfDataField drops characters which would break the entry
+// out of its field, drop lists them
+func cleanPerfDataField(s, drop string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(drop, r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// String formats performance data entry, quoting label if necessary.
+// Characters breaking the format are removed from the fields.
+func (p PerfData) String() string {
+	var b strings.Builder
+
+	// pipe and new lines split the output even in quoted label
+	label := cleanPerfDataField(p.Label, "|\r\n")
+
+	if label == "" || strings.ContainsAny(label, " \t'=") {
+		b.WriteByte('\'')
+		b.WriteString(strings.Replace(label, "'", "''", -1))
+		b.WriteByte('\'')
+	} else {
+		b.WriteString(label)
+	}
+
+	b.WriteByte('=')
+
+	if p.Undetermined {
+		b.WriteByte('U')
+	} else {
+		b.WriteString(formatPerfDataNumber(p.Value))
+		b.WriteString(cleanPerfDataField(p.UOM, perfDataSeparators+"0123456789.,+-"))
+	}
+
+	fields := []string{cleanPerfDataField(p.Warn, perfDataSeparators), cleanPerfDataField(p.Crit, perfDataSeparators), "", ""}
+
+	if p.Min != nil {
+		fields[2] = formatPerfDataNumber(*p.Min)
+	}
+
+	if p.Max != nil {
+		fields[3] = formatPerfDataNumber(*p.Max)
+	}
+
+	// trailing empty fields are omitted
+	n := len(fields)
+
+	for n > 0 && fields[n-1] == "" {
+		n--
+	}
+
+	for _, f := range fields[:n] {
+		b.WriteByte(';')
+		b.WriteString(f)
+	}
+
+	return b.String()
+}
+
+// FormatPerfData formats list of performance data entries
+func FormatPerfData(perfData ...PerfData) string {
+	entries := make([]string, len(perfData))
+
+	for i, p := range perfData {
+		entries[i] = p.String()
+	}
+
+	return strings.Join(entries, " ")
+}
+
+// perfDataSeparators can't occur inside of unquoted fields
+const perfDataSeparators = " \t\r\n;|='"
+
+// removePipes removes pipe characters from text, pipe surrounded
+// by spaces leaves single space
+func removePipes(text string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(text); i++ {
+		if text[i] != '|' {
+			b.WriteByte(text[i])
+			continue
+		}
+
+		if i+1 < len(text) && text[i+1] == ' ' && (b.Len() == 0 || strings.HasSuffix(b.String(), " ")) {
+			i++
+		}
+	}
+
+	return b.String()
+}
+
+// FormatStatusLine joins text and performance data into status line.
+// Pipe characters are removed from the text, since they would
+// be taken for the start of performance data.
+func FormatStatusLine(text string, perfData ...PerfData) string {
+	text = removePipes(text)
+
+	if len(perfData) == 0 {
+		return text
+	}
+
+	return text + " | " + FormatPerfData(perfData...)
+}
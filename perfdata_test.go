@@ -0,0 +1,128 @@
+package nrpe
+
+import (
+	"testing"
+)
+
+func testFloat(v float64) *float64 {
+	return &v
+}
+
+func TestParsePerfData(t *testing.T) {
+	perfData, err := ParsePerfData(
+		"time=0.010s;1.000;2.000;0.000 'in use'=45%;80;90;0;100 " +
+			"'it''s'=U count=12c;;;; size=1,5KB;@10:20 exp=1e3")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PerfData{
+		{Label: "time", Value: 0.01, UOM: "s", Warn: "1.000", Crit: "2.000",
+			Min: testFloat(0)},
+		{Label: "in use", Value: 45, UOM: "%", Warn: "80", Crit: "90",
+			Min: testFloat(0), Max: testFloat(100)},
+		{Label: "it's", Undetermined: true},
+		{Label: "count", Value: 12, UOM: "c"},
+		{Label: "size", Value: 1.5, UOM: "KB", Warn: "@10:20"},
+		{Label: "exp", Value: 1000},
+	}
+
+	if len(perfData) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(perfData))
+	}
+
+	for i := range expected {
+		if perfData[i].String() != expected[i].String() {
+			t.Fatalf("Entry %d: expected %q, got %q",
+				i, expected[i].String(), perfData[i].String())
+		}
+	}
+}
+
+func TestParsePerfDataError(t *testing.T) {
+	for _, s := range []string{
+		"novalue",
+		"=1",
+		"'unterminated=1",
+		"''=1",
+		"label=abc",
+		"label=1;2;3;4;5;6",
+		"label=1;;;x",
+		"label=NaN",
+		"label=1;;;-Inf",
+	} {
+		if _, err := ParsePerfData(s); err == nil {
+			t.Fatalf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestParseStatusLine(t *testing.T) {
+	text, perfData, err := ParseStatusLine("OK - load average: 0.1 | load1=0.1;5;10;0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text != "OK - load average: 0.1" {
+		t.Fatalf("Unexpected text %q", text)
+	}
+
+	if len(perfData) != 1 || perfData[0].Label != "load1" || perfData[0].Value != 0.1 {
+		t.Fatal("Unexpected perfdata")
+	}
+
+	text, perfData, err = ParseStatusLine("OK")
+
+	if err != nil || text != "OK" || perfData != nil {
+		t.Fatal("Unexpected result without perfdata")
+	}
+}
+
+func TestFormatPerfData(t *testing.T) {
+	s := FormatPerfData(
+		PerfData{Label: "a b", Value: 1.5, UOM: "s", Warn: "1", Crit: "2"},
+		PerfData{Label: "x=y", Value: -2, Min: testFloat(-10)},
+		PerfData{Label: "it's", Undetermined: true},
+	)
+
+	if s != "'a b'=1.5s;1;2 'x=y'=-2;;;-10 'it''s'=U" {
+		t.Fatalf("Unexpected result %q", s)
+	}
+
+	perfData, err := ParsePerfData(s)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if FormatPerfData(perfData...) != s {
+		t.Fatal("Formatted perfdata didn't survive parsing")
+	}
+
+	for text, expected := range map[string]string{
+		"OK | fine": "OK fine | a=1",
+		"|OK|":      "OK | a=1",
+		"| OK a|b":  "OK ab | a=1",
+	} {
+		if s := FormatStatusLine(text, PerfData{Label: "a", Value: 1}); s != expected {
+			t.Fatalf("Expected status line %q, got %q", expected, s)
+		}
+	}
+}
+
+func TestFormatPerfDataClean(t *testing.T) {
+	s := FormatPerfData(
+		PerfData{Label: "a|b\n", Value: 1, UOM: "m s|1", Warn: "1;2 | x=y", Crit: "@'10:20'"},
+		PerfData{Label: "x", Value: 2, UOM: "=", Warn: "|"},
+	)
+
+	if s != "ab=1ms;12xy;@10:20 x=2" {
+		t.Fatalf("Unexpected result %q", s)
+	}
+
+	if _, err := ParsePerfData(s); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,145 @@
+package nrpe
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Range represents threshold range in the nagios [@]start:end format
+type Range struct {
+	// Start is negative infinity for the "~" start
+	Start float64
+	// End is positive infinity if omitted
+	End float64
+	// Inside inverts the range ("@" prefix), alerting on values within it
+	Inside bool
+}
+
+// ParseRange parses threshold range such as
+// "10", "10:", "~:10", "10:20" or "@10:20"
+func ParseRange(s string) (*Range, error) {
+	r := Range{End: math.Inf(1)}
+
+	v := s
+
+	if strings.HasPrefix(v, "@") {
+		r.Inside = true
+		v = v[1:]
+	}
+
+	end := v
+
+	if pos := strings.IndexByte(v, ':'); pos != -1 {
+		start := v[:pos]
+		end = v[pos+1:]
+
+		switch start {
+		case "~":
+			r.Start = math.Inf(-1)
+		case "":
+		default:
+			n, err := parsePerfDataNumber(start)
+
+			if err != nil {
+				return nil, fmt.Errorf("nrpe: invalid range start in %q", s)
+			}
+
+			r.Start = n
+		}
+	} else if end == "" {
+		return nil, fmt.Errorf("nrpe: empty range")
+	}
+
+	if end != "" {
+		n, err := parsePerfDataNumber(end)
+
+		if err != nil {
+			return nil, fmt.Errorf("nrpe: invalid range end in %q", s)
+		}
+
+		r.End = n
+	}
+
+	if r.Start > r.End {
+		return nil, fmt.Errorf("nrpe: range start is greater than end in %q", s)
+	}
+
+	return &r, nil
+}
+
+// Alert reports whether the value should raise an alert
+func (r Range) Alert(value float64) bool {
+	inside := value >= r.Start && value <= r.End
+
+	if r.Inside {
+		return inside
+	}
+
+	return !inside
+}
+
+// String formats range back to the nagios format
+func (r Range) String() string {
+	var s string
+
+	if r.Inside {
+		s = "@"
+	}
+
+	switch {
+	case math.IsInf(r.Start, -1):
+		s += "~:"
+	case r.Start != 0:
+		s += strconv.FormatFloat(r.Start, 'f', -1, 64) + ":"
+	case math.IsInf(r.End, 1):
+		s += "0:"
+	}
+
+	if !math.IsInf(r.End, 1) {
+		s += strconv.FormatFloat(r.End, 'f', -1, 64)
+	}
+
+	return s
+}
+
+// CheckThresholds evaluates value against warning and critical ranges,
+// either of which may be nil
+func CheckThresholds(value float64, warning, critical *Range) CommandStatus {
+	if critical != nil && critical.Alert(value) {
+		return StatusCritical
+	}
+
+	if warning != nil && warning.Alert(value) {
+		return StatusWarning
+	}
+
+	return StatusOK
+}
+
+// Status evaluates the value against the warn and crit ranges
+// of the performance data entry
+func (p PerfData) Status() (CommandStatus, error) {
+	if p.Undetermined {
+		return StatusUnknown, nil
+	}
+
+	var ranges [2]*Range
+
+	for i, s := range []string{p.Warn, p.Crit} {
+		if s == "" {
+			continue
+		}
+
+		r, err := ParseRange(s)
+
+		if err != nil {
+			return StatusUnknown, err
+		}
+
+		ranges[i] = r
+	}
+
+	return CheckThresholds(p.Value, ranges[0], ranges[1]), nil
+}
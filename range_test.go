@@ -0,0 +1,96 @@
+package nrpe
+
+import (
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s      string
+		alert  []float64
+		ok     []float64
+		format string
+	}{
+		{"10", []float64{-1, 10.5, 100}, []float64{0, 5, 10}, "10"},
+		{"10:", []float64{-5, 9.9}, []float64{10, 1e9}, "10:"},
+		{"~:10", []float64{10.1, 20}, []float64{-1e9, 10}, "~:10"},
+		{"10:20", []float64{9, 21}, []float64{10, 15, 20}, "10:20"},
+		{"@10:20", []float64{10, 15, 20}, []float64{9, 21}, "@10:20"},
+		{"-5:-1", []float64{0, -6}, []float64{-5, -1}, "-5:-1"},
+		{"0:", []float64{-1}, []float64{0, 1}, "0:"},
+		{":5", []float64{-1, 6}, []float64{0, 5}, "5"},
+	}
+
+	for _, test := range tests {
+		r, err := ParseRange(test.s)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, v := range test.alert {
+			if !r.Alert(v) {
+				t.Fatalf("Range %q: expected alert for %v", test.s, v)
+			}
+		}
+
+		for _, v := range test.ok {
+			if r.Alert(v) {
+				t.Fatalf("Range %q: unexpected alert for %v", test.s, v)
+			}
+		}
+
+		if r.String() != test.format {
+			t.Fatalf("Range %q: unexpected format %q", test.s, r.String())
+		}
+	}
+}
+
+func TestParseRangeError(t *testing.T) {
+	for _, s := range []string{"", "@", "abc", "10:abc", "x:10", "20:10", "NaN", "inf", "-Inf:10", "~:infinity", "@nan:5"} {
+		if _, err := ParseRange(s); err == nil {
+			t.Fatalf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestCheckThresholds(t *testing.T) {
+	warning, _ := ParseRange("80")
+	critical, _ := ParseRange("90")
+
+	if CheckThresholds(50, warning, critical) != StatusOK {
+		t.Fatal("Expected OK")
+	}
+
+	if CheckThresholds(85, warning, critical) != StatusWarning {
+		t.Fatal("Expected WARNING")
+	}
+
+	if CheckThresholds(95, warning, critical) != StatusCritical {
+		t.Fatal("Expected CRITICAL")
+	}
+
+	if CheckThresholds(95, nil, nil) != StatusOK {
+		t.Fatal("Expected OK without thresholds")
+	}
+}
+
+func TestPerfDataStatus(t *testing.T) {
+	perfData, err := ParsePerfData("a=85%;80;90 b=U;1;2 c=1;x")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := perfData[0].Status(); err != nil || s != StatusWarning {
+		t.Fatal("Expected WARNING")
+	}
+
+	if s, err := perfData[1].Status(); err != nil || s != StatusUnknown {
+		t.Fatal("Expected UNKNOWN")
+	}
+
+	if _, err := perfData[2].Status(); err == nil {
+		t.Fatal("Expected error")
+	}
+}
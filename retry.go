@@ -0,0 +1,120 @@
+package nrpe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// RetryOn selects failures which are retried
+type RetryOn int
+
+const (
+	// RetryOnConnect retries failed connects
+	RetryOnConnect RetryOn = 1 << iota
+	// RetryOnHandshake retries failed ssl handshakes
+	RetryOnHandshake
+)
+
+var retryOnNames = []struct {
+	on   RetryOn
+	name string
+}{
+	{RetryOnConnect, "connect"},
+	{RetryOnHandshake, "handshake"},
+}
+
+// ParseRetryOn parses comma separated failure names, "connect" or "handshake"
+func ParseRetryOn(s string) (RetryOn, error) {
+	var on RetryOn
+
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		found := false
+
+		for _, n := range retryOnNames {
+			if strings.EqualFold(n.name, name) {
+				on |= n.on
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("nrpe: unknown retry failure %q", name)
+		}
+	}
+
+	return on, nil
+}
+
+// RetryPolicy retries checks which failed before the query was sent,
+// the query itself is never repeated
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one,
+	// zero or one means no retry
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled for every next one
+	Backoff time.Duration
+	// MaxBackoff limits the wait, zero means no limit
+	MaxBackoff time.Duration
+	// Jitter is the fraction of the wait which is randomized, from 0 to 1
+	Jitter float64
+	// On selects retried failures, zero means connect and handshake
+	On RetryOn
+}
+
+// retryable reports whether err is one of the retried failures
+func (p *RetryPolicy) retryable(err error) bool {
+	on := p.On
+
+	if on == 0 {
+		on = RetryOnConnect | RetryOnHandshake
+	}
+
+	var dialErr dialError
+	var hsErr handshakeError
+
+	return (on&RetryOnConnect != 0 && errors.As(err, &dialErr)) ||
+		(on&RetryOnHandshake != 0 && errors.As(err, &hsErr))
+}
+
+// backoff returns the wait after the given failed attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+
+	// without the limit doubling stops before the wait overflows
+	for i := 1; i < attempt && wait <= math.MaxInt64/2 && (p.MaxBackoff == 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		wait -= time.Duration(p.Jitter * rand.Float64() * float64(wait))
+	}
+
+	return wait
+}
+
+// sleepContext waits for d unless ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
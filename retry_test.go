@@ -0,0 +1,137 @@
+package nrpe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientRetryConnect(t *testing.T) {
+	var dials int32
+
+	client := &Client{Policy: SSLPolicyPlain, DialContext: testDialer(t, testServe(&Server{}), 2, &dials)}
+	client.Retry = RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, Jitter: 0.5}
+
+	result, err := client.Check(context.Background(), "agent", NewCommand("check"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.StatusCode != StatusOK || dials != 3 {
+		t.Fatalf("Expected success after %d dials, got %d", 3, dials)
+	}
+
+	dials = 0
+	client = &Client{Policy: SSLPolicyPlain, DialContext: testDialer(t, testServe(&Server{}), 3, &dials)}
+	client.Retry = RetryPolicy{MaxAttempts: 3}
+
+	var opErr *net.OpError
+
+	if _, err = client.Check(context.Background(), "agent", NewCommand("check")); !errors.As(err, &opErr) || dials != 3 {
+		t.Fatalf("Expected dial error after 3 dials, got %v after %d", err, dials)
+	}
+
+	dials = 0
+	client = &Client{Policy: SSLPolicyPlain, DialContext: testDialer(t, testServe(&Server{}), 1, &dials)}
+	client.Retry = RetryPolicy{MaxAttempts: 3, On: RetryOnHandshake}
+
+	if _, err = client.Check(context.Background(), "agent", NewCommand("check")); err == nil || dials != 1 {
+		t.Fatalf("Expected connect failure not to be retried, got %v after %d dials", err, dials)
+	}
+}
+
+func TestClientRetryNotAfterQuery(t *testing.T) {
+	var dials int32
+
+	// the server reads the query and drops the connection
+	client := &Client{Policy: SSLPolicyPlain, DialContext: testDialer(t, func(conn net.Conn) {
+		conn.Read(make([]byte, packetLength))
+		conn.Close()
+	}, 0, &dials)}
+	client.Retry = RetryPolicy{MaxAttempts: 3}
+
+	if _, err := client.Check(context.Background(), "agent", NewCommand("check")); err == nil || dials != 1 {
+		t.Fatalf("Expected failure without retry, got %v after %d dials", err, dials)
+	}
+}
+
+func TestClientRetryCanceled(t *testing.T) {
+	var dials int32
+
+	client := &Client{Policy: SSLPolicyPlain, DialContext: testDialer(t, testServe(&Server{}), 10, &dials)}
+	client.Retry = RetryPolicy{MaxAttempts: 10, Backoff: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Check(ctx, "agent", NewCommand("check")); err != context.DeadlineExceeded || dials != 1 {
+		t.Fatalf("Expected deadline error during backoff, got %v after %d dials", err, dials)
+	}
+}
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	dialErr := dialError{errors.New("refused")}
+	hsErr := handshakeError{errors.New("handshake failure")}
+	readErr := errors.New("read failure")
+
+	for _, c := range []struct {
+		on       RetryOn
+		err      error
+		expected bool
+	}{
+		{0, dialErr, true},
+		{0, hsErr, true},
+		{0, readErr, false},
+		{RetryOnConnect, hsErr, false},
+		{RetryOnHandshake, dialErr, false},
+		{RetryOnHandshake, fmt.Errorf("wrapped: %w", hsErr), true},
+	} {
+		p := RetryPolicy{On: c.on}
+
+		if p.retryable(c.err) != c.expected {
+			t.Fatalf("Unexpected retryable %v of %v with %d", !c.expected, c.err, c.on)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+	for attempt, expected := range []time.Duration{10, 20, 40, 50, 50, 50} {
+		if wait := p.backoff(attempt + 1); wait != expected*time.Millisecond {
+			t.Fatalf("Expected %v after attempt %d, got %v", expected*time.Millisecond, attempt+1, wait)
+		}
+	}
+
+	p.Jitter = 0.5
+
+	for i := 0; i < 100; i++ {
+		if wait := p.backoff(2); wait < 10*time.Millisecond || wait > 20*time.Millisecond {
+			t.Fatalf("Wait %v out of jitter range", wait)
+		}
+	}
+
+	p = RetryPolicy{Backoff: time.Second}
+
+	for _, attempt := range []int{40, 100, 1000} {
+		if wait := p.backoff(attempt); wait < p.Backoff {
+			t.Fatalf("Unlimited wait overflowed to %v after attempt %d", wait, attempt)
+		}
+	}
+}
+
+func TestParseRetryOn(t *testing.T) {
+	on, err := ParseRetryOn("connect, Handshake")
+
+	if err != nil || on != RetryOnConnect|RetryOnHandshake {
+		t.Fatalf("Unexpected %d: %v", on, err)
+	}
+
+	if _, err = ParseRetryOn("read"); err == nil {
+		t.Fatal("Expected error for unknown failure")
+	}
+}
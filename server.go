@@ -0,0 +1,256 @@
+package nrpe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Handler processes nrpe command, ctx carries information about
+// the connection, see ConnectionStateFromContext
+type Handler func(ctx context.Context, command Command) (*CommandResult, error)
+
+// PlainTextPolicy defines how the ssl server handles plain text clients
+type PlainTextPolicy int
+
+const (
+	// PlainTextRequireSSL doesn't detect plain text clients,
+	// they fail the ssl handshake
+	PlainTextRequireSSL PlainTextPolicy = iota
+	// PlainTextAllow serves plain text clients as well
+	PlainTextAllow
+	// PlainTextLog serves plain text clients and logs them
+	PlainTextLog
+	// PlainTextReject rejects plain text clients with ErrPlainTextRejected
+	PlainTextReject
+)
+
+// ErrPlainTextRejected is returned by the server for plain text
+// clients if PlainTextReject policy is set
+var ErrPlainTextRejected = errors.New("nrpe: plain text connection rejected")
+
+// Server serves nrpe requests with the given settings
+type Server struct {
+	// Handler is called for every request
+	Handler Handler
+	// SSL settings, plain text is used if nil
+	SSL *SSLConfig
+	// PlainText policy of the ssl server, unless it's PlainTextRequireSSL
+	// the server detects whether the client uses ssl
+	PlainText PlainTextPolicy
+	// ErrorLog is used to log plain text clients, standard logger if nil
+	ErrorLog *log.Logger
+	// Timeout limits each network operation, zero means no timeout
+	Timeout time.Duration
+	// HandshakeTimeout, ReadTimeout and WriteTimeout limit
+	// the single operations, Timeout is used if zero
+	HandshakeTimeout time.Duration
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	// Rand is the source of packet padding, see Client.Rand
+	Rand io.Reader
+}
+
+// RequestInfo describes the request the handler is serving
+type RequestInfo struct {
+	// RemoteAddr is the address of the client
+	RemoteAddr net.Addr
+	// ProtocolVersion is nrpe packet version of the request
+	ProtocolVersion int
+	// HandshakeDuration is time of the ssl handshake, zero for plain connections
+	HandshakeDuration time.Duration
+}
+
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns information about the request
+// the handler is serving
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// ServeOne handles one request received over conn, ctx is passed
+// to the handler with RequestInfo. Deadline and cancellation of ctx interrupt
+// network operations.
+func (s *Server) ServeOne(ctx context.Context, conn net.Conn) error {
+	err := s.serveOne(ctx, conn)
+
+	if err != nil {
+		if ctxErr := contextError(ctx); ctxErr != nil {
+			return ctxErr
+		}
+	}
+
+	return err
+}
+
+func (s *Server) serveOne(ctx context.Context, conn net.Conn) error {
+	var err error
+	var ssl sslConnection
+
+	info := &RequestInfo{RemoteAddr: conn.RemoteAddr()}
+
+	if ctx.Done() != nil {
+		cc := newContextConn(ctx, conn)
+		defer cc.stop()
+		conn = cc
+	}
+
+	useSSL := s.SSL != nil
+
+	if useSSL && s.PlainText != PlainTextRequireSSL {
+		if conn, useSSL, err = detectSSL(conn, orTimeout(s.ReadTimeout, s.Timeout)); err != nil {
+			return err
+		}
+
+		if !useSSL {
+			switch s.PlainText {
+			case PlainTextReject:
+				return ErrPlainTextRejected
+			case PlainTextLog:
+				s.logf("nrpe: plain text connection from %v", conn.RemoteAddr())
+			}
+		}
+	}
+
+	// setup ssl
+	if useSSL {
+		ssl, err = newSSLServerConn(conn, s.SSL)
+		if err != nil {
+			return err
+		}
+		defer ssl.Clean()
+
+		start := time.Now()
+
+		if err = sslHandshake(ctx, ssl, orTimeout(s.HandshakeTimeout, s.Timeout)); err != nil {
+			return err
+		}
+
+		info.HandshakeDuration = time.Since(start)
+
+		conn = ssl
+	}
+
+	request := getPacket()
+	defer putPacket(request)
+
+	if err = readPacket(conn, orTimeout(s.ReadTimeout, s.Timeout), request); err != nil {
+		return err
+	}
+
+	if err = verifyPacket(request, queryPacketType); err != nil {
+		return err
+	}
+
+	var pos = bytes.IndexByte(request.data, 0)
+
+	if pos == -1 {
+		return fmt.Errorf("nrpe: invalid request")
+	}
+
+	data := strings.Split(string(request.data[:pos]), "!")
+
+	if ssl != nil {
+		ctx = contextWithConnectionState(ctx, ssl.sslState())
+	}
+
+	info.ProtocolVersion = int(binary.BigEndian.Uint16(request.packetVersion))
+	ctx = context.WithValue(ctx, requestInfoKey{}, info)
+
+	result, err := s.Handler(ctx, NewCommand(data[0], data[1:]...))
+
+	if err != nil {
+		return err
+	}
+
+	response, err := buildPacket(responsePacketType,
+		uint16(result.StatusCode), normalizeOutput(result.StatusLine), s.Rand)
+
+	if err != nil {
+		return err
+	}
+
+	defer putPacket(response)
+
+	if err = writePacket(conn, orTimeout(s.WriteTimeout, s.Timeout), response); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// peekConn returns peeked bytes before reading from the connection
+type peekConn struct {
+	net.Conn
+	peeked []byte
+	err    error
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+
+	if len(c.peeked) == 0 {
+		return c.Conn.Read(b)
+	}
+
+	n := copy(b, c.peeked)
+	c.peeked = c.peeked[n:]
+
+	// packets are read by a single call, so the rest is read as well,
+	// an error is reported by the next call
+	if n < len(b) {
+		var m int
+
+		m, c.err = c.Conn.Read(b[n:])
+		n += m
+	}
+
+	return n, nil
+}
+
+// recordTypeHandshake is the content type of ssl handshake records
+const recordTypeHandshake = 22
+
+// detectSSL peeks at the first byte sent by the client, ssl starts
+// with handshake record while nrpe packet starts with big endian version
+func detectSSL(conn net.Conn, timeout time.Duration) (net.Conn, bool, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	b := make([]byte, 1)
+
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, false, err
+	}
+
+	switch b[0] {
+	case recordTypeHandshake:
+		return &peekConn{Conn: conn, peeked: b}, true, nil
+	case 0:
+		return &peekConn{Conn: conn, peeked: b}, false, nil
+	}
+
+	return nil, false, fmt.Errorf("nrpe: unknown protocol, first byte %#02x", b[0])
+}
@@ -0,0 +1,182 @@
+package nrpe
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRunWithConfig runs one command between client and server,
+// returning the result and the ssl state seen by the handler
+func testRunWithConfig(t *testing.T, client *Client, server *Server) (*CommandResult, *ConnectionState, error, error) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	var serverState *ConnectionState
+
+	server.Handler = func(ctx context.Context, command Command) (*CommandResult, error) {
+		serverState = ConnectionStateFromContext(ctx)
+		return &CommandResult{StatusLine: "OK", StatusCode: StatusOK}, nil
+	}
+
+	c := make(chan error)
+
+	go func() {
+		err := server.ServeOne(context.Background(), sock.server)
+		sock.server.Close()
+		c <- err
+	}()
+
+	result, err := client.Run(context.Background(), sock.client, NewCommand("check_identity"))
+
+	sock.client.Close()
+
+	return result, serverState, err, <-c
+}
+
+func TestServerPlainTextAllow(t *testing.T) {
+	var buf bytes.Buffer
+
+	server := &Server{SSL: &SSLConfig{}, PlainText: PlainTextAllow, ErrorLog: log.New(&buf, "", 0)}
+
+	result, serverState, err, serverErr := testRunWithConfig(t, &Client{}, server)
+
+	if err != nil || serverErr != nil {
+		t.Fatal(err, serverErr)
+	}
+
+	if result.StatusLine != "OK" || result.SSL != nil || serverState != nil {
+		t.Fatal("Unexpected response")
+	}
+
+	if buf.Len() != 0 {
+		t.Fatal("Expected no log")
+	}
+}
+
+func TestServerPlainTextLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	server := &Server{SSL: &SSLConfig{}, PlainText: PlainTextLog, ErrorLog: log.New(&buf, "", 0)}
+
+	if _, _, err, serverErr := testRunWithConfig(t, &Client{}, server); err != nil || serverErr != nil {
+		t.Fatal(err, serverErr)
+	}
+
+	if !strings.HasPrefix(buf.String(), "nrpe: plain text connection from") {
+		t.Fatalf("Unexpected log %q", buf.String())
+	}
+}
+
+func TestServerPlainTextReject(t *testing.T) {
+	server := &Server{SSL: &SSLConfig{}, PlainText: PlainTextReject}
+
+	_, _, err, serverErr := testRunWithConfig(t, &Client{}, server)
+
+	if err == nil || serverErr != ErrPlainTextRejected {
+		t.Fatal("Expected rejected connection")
+	}
+}
+
+func TestServerDetectUnknownProtocol(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	server := &Server{SSL: &SSLConfig{}, PlainText: PlainTextAllow}
+
+	go sock.client.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+
+	err := server.ServeOne(context.Background(), sock.server)
+
+	if err == nil || !strings.HasPrefix(err.Error(), "nrpe: unknown protocol") {
+		t.Fatalf("Expected unknown protocol error, got %v", err)
+	}
+}
+
+func TestPeekConnReadError(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	conn := &peekConn{Conn: &testConn{Conn: sock.server, read: func(b []byte) (int, error) {
+		return 0, io.ErrUnexpectedEOF
+	}}, peeked: []byte("a")}
+
+	b := make([]byte, 3)
+
+	if n, err := conn.Read(b); n != 1 || err != nil {
+		t.Fatalf("Expected peeked byte, got %d: %v", n, err)
+	}
+
+	if _, err := conn.Read(b); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected error of the underlying read, got %v", err)
+	}
+}
+
+func TestServerDetectSSL(t *testing.T) {
+	testRequireSSL(t)
+
+	certs := testCreateCertificates(t)
+
+	configs := [][2]*SSLConfig{
+		{{}, {}},
+		{{CAFile: certs.ca}, {CertFile: certs.serverCert, KeyFile: certs.serverKey}},
+	}
+
+	for _, policy := range []PlainTextPolicy{PlainTextAllow, PlainTextReject} {
+		for _, c := range configs {
+			result, serverState, err, serverErr := testRunWithConfig(t, &Client{SSL: c[0]},
+				&Server{SSL: c[1], PlainText: policy})
+
+			if err != nil || serverErr != nil {
+				t.Fatal(err, serverErr)
+			}
+
+			if result.SSL == nil || serverState == nil {
+				t.Fatal("Expected ssl connection")
+			}
+		}
+	}
+}
+
+func TestServerHandshakeTimeoutOnly(t *testing.T) {
+	testRequireSSL(t)
+
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	// the handshake deadline must not limit the slow request
+	server := &Server{
+		SSL:              &SSLConfig{},
+		HandshakeTimeout: 200 * time.Millisecond,
+		Handler: func(ctx context.Context, command Command) (*CommandResult, error) {
+			time.Sleep(500 * time.Millisecond)
+			return &CommandResult{StatusLine: "OK", StatusCode: StatusOK}, nil
+		},
+	}
+
+	c := make(chan error, 1)
+
+	go func() {
+		c <- server.ServeOne(context.Background(), sock.server)
+	}()
+
+	client := Client{SSL: &SSLConfig{}, HandshakeTimeout: 200 * time.Millisecond}
+
+	result, err := client.Run(context.Background(), sock.client, NewCommand("check_slow"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	if result.StatusCode != StatusOK {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+}
@@ -1,16 +1,24 @@
-// +build cgo
+//go:build cgo && !nrpe_purego
+// +build cgo,!nrpe_purego
 
 package nrpe
 
 import (
+	"context"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"net"
+	"runtime"
 	"sync"
+	"time"
 	"unsafe"
 )
 
 /*
 #cgo LDFLAGS: -lcrypto -lssl
+#include <stdlib.h>
+#include <stdint.h>
 #include <pthread.h>
 #include <openssl/rsa.h>
 #include <openssl/crypto.h>
@@ -20,7 +28,9 @@ import (
 #include <openssl/err.h>
 #include <openssl/bio.h>
 
-// openssl multi-threading
+#if OPENSSL_VERSION_NUMBER < 0x10100000L
+
+// openssl 1.0.x multi-threading, newer versions lock internally
 static pthread_mutex_t *nrpe_locks;
 
 static void nrpe_openssl_thread_callback(int mode, int index, const char * file, int line) {
@@ -31,7 +41,7 @@ static void nrpe_openssl_thread_callback(int mode, int index, const char * file,
     }
 }
 
-static int nrpe_openssl_init() {
+static int nrpe_openssl_init_locks() {
     int i, j, rc, locks;
 
     rc = 0;
@@ -53,7 +63,7 @@ static int nrpe_openssl_init() {
 
     if (rc != 0) {
         for (j = 0; j < i; j++) {
-            pthread_mutex_destroy(&nrpe_locks[i]);
+            pthread_mutex_destroy(&nrpe_locks[j]);
         }
         free(nrpe_locks);
         nrpe_locks = NULL;
@@ -65,12 +75,38 @@ static int nrpe_openssl_init() {
     return 0;
 }
 
+// accessors of opaque BIO fields introduced in openssl 1.1
+
+static void BIO_set_init(BIO *b, int init) {
+	b->init = init;
+}
+
+static void BIO_set_data(BIO *b, void *ptr) {
+	b->ptr = ptr;
+}
+
+static void *BIO_get_data(BIO *b) {
+	return b->ptr;
+}
+
+#endif
+
 // BIO handler
 
-static long SSL_CTX_set_options_func(SSL_CTX *ctx, long options) {
-	return SSL_CTX_set_options(ctx, options);
+// conn is the address of sslConn, which is pinned while the BIO exists
+static void nrpe_bio_set_conn(BIO *b, uintptr_t conn) {
+	BIO_set_data(b, (void *)conn);
+}
+
+static void SSL_CTX_set_options_func(SSL_CTX *ctx, unsigned long long options) {
+	SSL_CTX_set_options(ctx, options);
 }
 
+#ifndef SSL_OP_NO_RENEGOTIATION
+// not available before openssl 1.1.0h
+#define SSL_OP_NO_RENEGOTIATION 0
+#endif
+
 extern int cBIONew(BIO *);
 extern int cBIOFree(BIO *);
 extern long cBIOCtrl(BIO *b, int, long, void *);
@@ -81,6 +117,8 @@ static int cBIOPuts(BIO *b, const char *str) {
 	return cBIOWrite(b, (char *)str, strlen(str));
 }
 
+#if OPENSSL_VERSION_NUMBER < 0x10100000L
+
 static BIO_METHOD goConnBioMethod = {
 	BIO_TYPE_SOURCE_SINK,
 	"Go net.Conn BIO",
@@ -98,69 +136,265 @@ static BIO_METHOD *BIO_s_go_conn() {
 	return &goConnBioMethod;
 }
 
-static long SSL_CTX_set_tmp_dh_func(SSL_CTX *ctx, DH *dh) {
-	return SSL_CTX_set_tmp_dh(ctx, dh);
+static int nrpe_openssl_init() {
+	SSL_library_init();
+	SSL_load_error_strings();
+
+	return nrpe_openssl_init_locks();
 }
 
-*/
-import "C"
+static const SSL_METHOD *nrpe_client_method() {
+	return SSLv23_client_method();
+}
 
-const (
-	stateInitial = iota
-	stateInHandshake
-	stateReady
-	stateError
-)
+static const SSL_METHOD *nrpe_server_method() {
+	return SSLv23_server_method();
+}
 
-type sslConn struct {
-	net.Conn
-	ctx   *C.SSL_CTX
-	ssl   *C.SSL
-	ptr   unsafe.Pointer
-	state int
+static int nrpe_set_dh(SSL_CTX *ctx, const char *pem, int length) {
+	BIO *bio;
+	DH *dh;
+	long rc;
+
+	bio = BIO_new_mem_buf((void *)pem, length);
+
+	if (bio == NULL) {
+		return 0;
+	}
+
+	dh = PEM_read_bio_DHparams(bio, NULL, NULL, NULL);
+	BIO_free(bio);
+
+	if (dh == NULL) {
+		return 0;
+	}
+
+	// the context keeps its own copy
+	rc = SSL_CTX_set_tmp_dh(ctx, dh);
+	DH_free(dh);
+
+	return rc == 1;
 }
 
-type connectionMap struct {
-	lock   sync.Mutex
-	values map[unsafe.Pointer]*sslConn
+// ADH is allowed by default in openssl 1.0.x
+static void nrpe_allow_anonymous(SSL_CTX *ctx) {
 }
 
-func (c *connectionMap) add(k unsafe.Pointer, v *sslConn) {
-	c.lock.Lock()
-	c.values[k] = v
-	c.lock.Unlock()
+// openssl 1.0.x has no version range, older versions are disabled by options
+static int nrpe_set_proto_versions(SSL_CTX *ctx, int min, int max) {
+	long options = 0;
+
+	if (min > TLS1_2_VERSION || (max != 0 && max < TLS1_VERSION)) {
+		return 0;
+	}
+
+	if (min > TLS1_VERSION) {
+		options |= SSL_OP_NO_TLSv1;
+	}
+
+	if (min > TLS1_1_VERSION || (max != 0 && max < TLS1_1_VERSION)) {
+		options |= SSL_OP_NO_TLSv1_1;
+	}
+
+	if (max != 0 && max < TLS1_2_VERSION) {
+		options |= SSL_OP_NO_TLSv1_2;
+	}
+
+	SSL_CTX_set_options(ctx, options);
+
+	return 1;
 }
 
-func (c *connectionMap) del(k unsafe.Pointer) {
-	c.lock.Lock()
-	delete(c.values, k)
-	c.lock.Unlock()
+#else
+
+static BIO_METHOD *goConnBioMethod;
+
+static BIO_METHOD *BIO_s_go_conn() {
+	return goConnBioMethod;
 }
 
-func (c *connectionMap) get(k unsafe.Pointer) *sslConn {
-	c.lock.Lock()
-	r := c.values[k]
-	c.lock.Unlock()
+static int nrpe_openssl_init() {
+	if (OPENSSL_init_ssl(OPENSSL_INIT_LOAD_SSL_STRINGS | OPENSSL_INIT_LOAD_CRYPTO_STRINGS, NULL) != 1) {
+		return -1;
+	}
 
-	return r
+	goConnBioMethod = BIO_meth_new(BIO_get_new_index() | BIO_TYPE_SOURCE_SINK, "Go net.Conn BIO");
+
+	if (goConnBioMethod == NULL) {
+		return -1;
+	}
+
+	BIO_meth_set_write(goConnBioMethod, (int (*)(BIO *, const char *, int))cBIOWrite);
+	BIO_meth_set_read(goConnBioMethod, cBIORead);
+	BIO_meth_set_puts(goConnBioMethod, cBIOPuts);
+	BIO_meth_set_ctrl(goConnBioMethod, cBIOCtrl);
+	BIO_meth_set_create(goConnBioMethod, cBIONew);
+	BIO_meth_set_destroy(goConnBioMethod, cBIOFree);
+
+	return 0;
 }
 
-var connMap connectionMap
+static const SSL_METHOD *nrpe_client_method() {
+	return TLS_client_method();
+}
 
-func init() {
-	C.SSL_library_init()
-	C.SSL_load_error_strings()
-	C.nrpe_openssl_init()
+static const SSL_METHOD *nrpe_server_method() {
+	return TLS_server_method();
+}
 
-	connMap.values = make(map[unsafe.Pointer]*sslConn)
+static int nrpe_set_dh(SSL_CTX *ctx, const char *pem, int length) {
+	BIO *bio;
+	EVP_PKEY *pkey = NULL;
+
+	bio = BIO_new_mem_buf(pem, length);
+
+	if (bio == NULL) {
+		return 0;
+	}
+
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+	pkey = PEM_read_bio_Parameters(bio, NULL);
+	BIO_free(bio);
+
+	if (pkey == NULL) {
+		return 0;
+	}
+
+	// the context takes ownership of pkey on success
+	if (SSL_CTX_set0_tmp_dh_pkey(ctx, pkey) != 1) {
+		EVP_PKEY_free(pkey);
+		return 0;
+	}
+
+	return 1;
+#else
+	DH *dh;
+	long rc;
+
+	dh = PEM_read_bio_DHparams(bio, NULL, NULL, NULL);
+	BIO_free(bio);
+
+	if (dh == NULL) {
+		return 0;
+	}
+
+	rc = SSL_CTX_set_tmp_dh(ctx, dh);
+	DH_free(dh);
+
+	return rc == 1;
+#endif
+}
+
+// anonymous suites are rejected by the default security level
+static void nrpe_allow_anonymous(SSL_CTX *ctx) {
+	SSL_CTX_set_security_level(ctx, 0);
+}
+
+static int nrpe_set_proto_versions(SSL_CTX *ctx, int min, int max) {
+	return SSL_CTX_set_min_proto_version(ctx, min) == 1 &&
+		SSL_CTX_set_max_proto_version(ctx, max) == 1;
+}
+
+#endif
+
+static unsigned int nrpe_cipher_id(SSL *ssl) {
+	const SSL_CIPHER *cipher = SSL_get_current_cipher(ssl);
+
+	if (cipher == NULL) {
+		return 0;
+	}
+
+	// the low 16 bits are the IANA id
+	return SSL_CIPHER_get_id(cipher) & 0xffff;
+}
+
+// nrpe_cipher_uses_dhe reports whether the key exchange is finite field DH
+static int nrpe_cipher_uses_dhe(SSL *ssl) {
+	const SSL_CIPHER *cipher = SSL_get_current_cipher(ssl);
+
+	if (cipher == NULL) {
+		return 0;
+	}
+
+#if OPENSSL_VERSION_NUMBER >= 0x10100000L
+	return SSL_CIPHER_get_kx_nid(cipher) == NID_kx_dhe;
+#else
+	const char *name = SSL_CIPHER_get_name(cipher);
+
+	return strstr(name, "DH") != NULL && strstr(name, "ECDH") == NULL;
+#endif
+}
+
+// nrpe_peer_dh_bits returns size of the DH key sent by the server
+static int nrpe_peer_dh_bits(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x10002000L
+	EVP_PKEY *key = NULL;
+	int bits = 0;
+
+	if (SSL_get_server_tmp_key(ssl, &key) != 1) {
+		return 0;
+	}
+
+	if (EVP_PKEY_id(key) == EVP_PKEY_DH) {
+		bits = EVP_PKEY_bits(key);
+	}
+
+	EVP_PKEY_free(key);
+
+	return bits;
+#else
+	return 0;
+#endif
+}
+
+static X509 *nrpe_get_peer_certificate(SSL *ssl) {
+#if OPENSSL_VERSION_NUMBER >= 0x30000000L
+	return SSL_get1_peer_certificate(ssl);
+#else
+	return SSL_get_peer_certificate(ssl);
+#endif
+}
+
+*/
+import "C"
+
+const (
+	stateInitial = iota
+	stateInHandshake
+	stateReady
+	stateError
+	stateClosed
+)
+
+type sslConn struct {
+	net.Conn
+	ctx               *sslContext
+	ssl               *C.SSL
+	pinner            runtime.Pinner
+	state             int
+	verify            bool
+	server            bool
+	dhBits            int
+	handshakeDuration time.Duration
+	// bioErr is the error of the underlying connection seen by the BIO
+	bioErr error
+	// lock serializes use of ssl, Read and Write don't run concurrently
+	lock sync.Mutex
 }
 
+// opensslInit initializes the library on first use of ssl
+var opensslInit = sync.OnceValue(func() error {
+	if C.nrpe_openssl_init() != 0 {
+		return goifyError("nrpe: cannot initialize openssl")
+	}
+
+	return nil
+})
+
 //export cBIONew
 func cBIONew(b *C.BIO) C.int {
-	b.init = 1
-	b.num = -1
-	b.ptr = nil
-	b.flags = 0
+	C.BIO_set_init(b, 1)
+	C.BIO_set_data(b, nil)
 	return 1
 }
 
@@ -180,7 +414,7 @@ func cBIOWrite(b *C.BIO, buf *C.char, length C.int) C.int {
 		}
 	}()
 
-	conn := connMap.get(unsafe.Pointer(b))
+	conn := (*sslConn)(C.BIO_get_data(b))
 
 	if conn == nil {
 		return -1
@@ -188,7 +422,12 @@ func cBIOWrite(b *C.BIO, buf *C.char, length C.int) C.int {
 
 	l, err = conn.Conn.Write((*(*[1<<31 - 1]byte)(unsafe.Pointer(buf)))[:int(length)])
 
-	if err != nil || l != int(length) {
+	if err == nil && l != int(length) {
+		err = io.ErrShortWrite
+	}
+
+	if err != nil {
+		conn.bioErr = err
 		l = -1
 	}
 
@@ -206,7 +445,7 @@ func cBIORead(b *C.BIO, buf *C.char, length C.int) C.int {
 		}
 	}()
 
-	conn := connMap.get(unsafe.Pointer(b))
+	conn := (*sslConn)(C.BIO_get_data(b))
 
 	if conn == nil {
 		return -1
@@ -214,7 +453,9 @@ func cBIORead(b *C.BIO, buf *C.char, length C.int) C.int {
 
 	l, err = conn.Conn.Read((*(*[1<<31 - 1]byte)(unsafe.Pointer(buf)))[:int(length)])
 
-	if err != nil || l != int(length) {
+	// short reads are fine, openssl asks again for the rest of the record
+	if l == 0 && err != nil {
+		conn.bioErr = err
 		l = -1
 	}
 
@@ -241,149 +482,384 @@ func goifyError(format string, a ...interface{}) error {
 	)
 }
 
-func (c sslConn) Clean() {
+// ioError returns error of failed ssl io, wrapping the error of the
+// underlying connection if it caused the failure, e.g. a timeout
+func (c *sslConn) ioError(msg string) error {
+	if c.bioErr != nil {
+		return fmt.Errorf("%s: %w", msg, c.bioErr)
+	}
+
+	return goifyError("%s", msg)
+}
+
+// Clean releases ssl resources, it's safe to call it more than once.
+// It waits for the running Read, Write or Handshake.
+func (c *sslConn) Clean() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.clean()
+}
+
+func (c *sslConn) clean() {
 	if c.ssl != nil {
 		C.SSL_free(c.ssl)
 		c.ssl = nil
 	}
-	if c.ctx != nil {
-		C.SSL_CTX_free(c.ctx)
-		c.ctx = nil
+	// the BIO is freed with ssl, so it can't reach the connection anymore
+	c.pinner.Unpin()
+	c.ctx = nil
+	c.state = stateClosed
+}
+
+func (c *sslConn) sslState() *ConnectionState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	state := &ConnectionState{}
+
+	if c.ssl == nil || c.state != stateReady {
+		return state
+	}
+
+	state.Version = SSLVersion(C.SSL_version(c.ssl))
+	state.CipherSuite = uint16(C.nrpe_cipher_id(c.ssl))
+	state.HandshakeDuration = c.handshakeDuration
+
+	if C.nrpe_cipher_uses_dhe(c.ssl) == 1 {
+		// the server's key is gone after the handshake,
+		// but its size is the size of configured parameters
+		if c.server {
+			state.DHBits = c.dhBits
+		} else {
+			state.DHBits = int(C.nrpe_peer_dh_bits(c.ssl))
+		}
 	}
-	if c.ptr != nil {
-		connMap.del(c.ptr)
-		c.ptr = nil
+
+	cert := C.nrpe_get_peer_certificate(c.ssl)
+
+	if cert == nil {
+		return state
 	}
+
+	defer C.X509_free(cert)
+
+	n := C.i2d_X509(cert, nil)
+
+	if n <= 0 {
+		return state
+	}
+
+	buf := C.malloc(C.size_t(n))
+	defer C.free(buf)
+
+	p := (*C.uchar)(buf)
+	C.i2d_X509(cert, &p)
+
+	parsed, err := x509.ParseCertificate(C.GoBytes(buf, n))
+
+	if err != nil {
+		return state
+	}
+
+	state.PeerCertificate = parsed
+	state.Verified = c.verify && C.SSL_get_verify_result(c.ssl) == C.X509_V_OK
+
+	return state
 }
 
-func (c sslConn) Close() error {
-	c.Clean()
+// Close sends close_notify if the handshake is done, releases ssl
+// resources and closes underlying connection. Peer's close_notify
+// isn't awaited, the connection isn't reused. Running Read, Write
+// or Handshake is interrupted by closing the connection first,
+// close_notify isn't sent then.
+func (c *sslConn) Close() error {
+	if !c.lock.TryLock() {
+		err := c.Conn.Close()
+
+		c.Clean()
+
+		return err
+	}
+
+	if c.state == stateReady {
+		C.ERR_clear_error()
+		C.SSL_shutdown(c.ssl)
+	}
+
+	c.clean()
+	c.lock.Unlock()
+
 	return c.Conn.Close()
 }
 
-func (c sslConn) Read(b []byte) (n int, err error) {
-	if c.state == stateError {
-		return 0, fmt.Errorf("nrpe: inconsistent connection state")
-	}
+// Handshake runs the ssl handshake unless it has already been done,
+// cancellation of ctx interrupts it. Read and Write call it implicitly.
+func (c *sslConn) Handshake(ctx context.Context) error {
+	return handshakeContext(ctx, c.Conn, func() error {
+		c.lock.Lock()
+		defer c.lock.Unlock()
 
-	if c.state == stateInitial {
-		c.state = stateInHandshake
-		if C.SSL_do_handshake(c.ssl) != 1 {
-			c.state = stateError
-			return 0, goifyError("nrpe: error on ssl handshake")
-		}
-		c.state = stateReady
+		return c.handshake()
+	})
+}
+
+func (c *sslConn) handshake() error {
+	switch c.state {
+	case stateReady:
+		return nil
+	case stateClosed:
+		return fmt.Errorf("nrpe: use of closed ssl connection")
+	case stateInitial:
+	default:
+		return fmt.Errorf("nrpe: inconsistent connection state")
 	}
 
-	rc := int(C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b))))
+	c.state = stateInHandshake
+
+	C.ERR_clear_error()
+	c.bioErr = nil
+
+	start := time.Now()
+
+	rc := C.SSL_do_handshake(c.ssl)
+
+	c.handshakeDuration = time.Since(start)
 
-	if rc < 0 {
-		return 0, goifyError("nrpe: error while reading")
+	if rc != 1 {
+		c.state = stateError
+		return c.ioError("nrpe: error on ssl handshake")
 	}
 
-	return rc, nil
+	c.state = stateReady
+
+	return nil
 }
 
-func (c sslConn) Write(b []byte) (n int, err error) {
-	if c.state == stateError {
-		return 0, fmt.Errorf("nrpe: inconsistent connection state")
+func (c *sslConn) Read(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err = c.handshake(); err != nil {
+		return 0, err
 	}
 
-	if c.state == stateInitial {
-		c.state = stateInHandshake
-		if C.SSL_do_handshake(c.ssl) != 1 {
-			c.state = stateError
-			return 0, goifyError("nrpe: error on ssl handshake")
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	C.ERR_clear_error()
+	c.bioErr = nil
+
+	rc := C.SSL_read(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b)))
+
+	if rc <= 0 {
+		if C.SSL_get_error(c.ssl, rc) == C.SSL_ERROR_ZERO_RETURN {
+			return 0, io.EOF
 		}
-		c.state = stateReady
+		return 0, c.ioError("nrpe: error while reading")
 	}
 
+	return int(rc), nil
+}
+
+func (c *sslConn) Write(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err = c.handshake(); err != nil {
+		return 0, err
+	}
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	C.ERR_clear_error()
+	c.bioErr = nil
+
 	rc := int(C.SSL_write(c.ssl, unsafe.Pointer(&b[0]), C.int(len(b))))
 
-	if rc < 0 {
-		return 0, goifyError("nrpe: error while writing")
+	if rc <= 0 {
+		return 0, c.ioError("nrpe: error while writing")
 	}
 
 	return rc, nil
 }
 
-func newSSLClient(conn net.Conn) (net.Conn, error) {
-	c := &sslConn{conn, nil, nil, nil, stateInitial}
+// sslContext is SSL_CTX shared by connections of one config
+type sslContext struct {
+	ctx    *C.SSL_CTX
+	verify bool
+	// dhBits is the size of DH parameters of the server
+	dhBits int
+}
 
-	meth := C.SSLv23_client_method()
+func (c *sslContext) free() {
+	C.SSL_CTX_free(c.ctx)
+}
 
-	c.ctx = C.SSL_CTX_new(meth)
+// getSSLContext returns context of the config, creating it on first use
+func getSSLContext(config *SSLConfig, server bool) (*sslContext, error) {
+	if config == nil {
+		config = anonymousSSLConfig
+	}
+
+	ctx, err := config.context(sslContextKey{"openssl", server}, func() (interface{}, error) {
+		return newSSLContext(config, server)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ctx.(*sslContext), nil
+}
+
+func newSSLContext(config *SSLConfig, server bool) (*sslContext, error) {
+	if err := opensslInit(); err != nil {
+		return nil, err
+	}
+
+	meth := C.nrpe_client_method()
+
+	if server {
+		meth = C.nrpe_server_method()
+	}
+
+	c := &sslContext{ctx: C.SSL_CTX_new(meth)}
 
 	if c.ctx == nil {
 		return nil, goifyError("nrpe: cannot create ssl context")
 	}
 
+	// connections hold own references, so the context
+	// is freed once the config and all connections are gone
+	runtime.SetFinalizer(c, (*sslContext).free)
+
 	// disable ssl2 and ssl3
-	C.SSL_CTX_set_options_func(c.ctx, C.SSL_OP_NO_SSLv2|C.SSL_OP_NO_SSLv3)
+	C.SSL_CTX_set_options_func(c.ctx, C.SSL_OP_NO_SSLv2|C.SSL_OP_NO_SSLv3|sslOptionFlags(config.Options))
 
-	// nrpe supports only Anonymous DH cipher suites
-	C.SSL_CTX_set_cipher_list(c.ctx, C.CString("ADH"))
+	min, max, err := config.versions(!config.certificateMode(server))
 
-	c.ssl = C.SSL_new(c.ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	if c.ssl == nil {
-		return nil, goifyError("nrpe: cannot create ssl")
+	if C.nrpe_set_proto_versions(c.ctx, C.int(min), C.int(max)) != 1 {
+		return nil, goifyError("nrpe: cannot set ssl versions %s - %s", min, max)
 	}
 
-	b := C.BIO_new(C.BIO_s_go_conn())
+	if config.certificateMode(server) {
+		if err := configureCertificates(c.ctx, config, server); err != nil {
+			return nil, err
+		}
 
-	if b == nil {
-		return nil, goifyError("nrpe: cannot create BIO")
-	}
+		if server {
+			c.verify = config.ClientCerts != NoClientCert
+		} else {
+			c.verify = config.CAFile != ""
+		}
+	} else {
+		// nrpe supports only Anonymous DH cipher suites
+		C.nrpe_allow_anonymous(c.ctx)
 
-	c.ptr = unsafe.Pointer(b)
-	b.ptr = c.ptr
+		cipherList := config.CipherList
 
-	// we can't pass GO pointer to C, so we will keep ctx in global map
-	// and use it to access ctx from callback functions
-	connMap.add(c.ptr, c)
+		if cipherList == "" {
+			cipherList = "ADH"
+		}
 
-	C.SSL_set_bio(c.ssl, b, b)
+		if err := setCipherList(c.ctx, cipherList); err != nil {
+			return nil, err
+		}
+	}
 
-	C.SSL_set_connect_state(c.ssl)
+	if server {
+		if c.dhBits, err = setDHParams(c.ctx, config); err != nil {
+			return nil, err
+		}
+	}
 
 	return c, nil
 }
 
-var dhparam *C.DH
-
-func init() {
-	dhparam = C.DH_new()
+// setDHParams loads DH parameters of anonymous DH suites,
+// returning size of the prime
+func setDHParams(ctx *C.SSL_CTX, config *SSLConfig) (int, error) {
+	params, err := getDHParams(config)
 
-	if dhparam == nil {
-		panic("cannot initialize dh")
+	if err != nil {
+		return 0, err
 	}
 
-	if C.DH_generate_parameters_ex(dhparam, 512, 2, nil) != 1 {
-		panic("cannot generate dh")
+	pem := params.pem()
+
+	cPem := C.CBytes(pem)
+	defer C.free(cPem)
+
+	if C.nrpe_set_dh(ctx, (*C.char)(cPem), C.int(len(pem))) != 1 {
+		return 0, goifyError("nrpe: cannot set DH parameters")
 	}
+
+	return params.P.BitLen(), nil
 }
 
-func newSSLServerConn(conn net.Conn) (net.Conn, error) {
-	c := &sslConn{conn, nil, nil, nil, stateInitial}
+// sslOptionFlags maps options to SSL_OP_* flags
+func sslOptionFlags(options SSLOptions) C.ulonglong {
+	var flags C.ulonglong
+
+	if options&SSLOptionAll != 0 {
+		flags |= C.SSL_OP_ALL
+	}
 
-	meth := C.SSLv23_server_method()
+	if options&SSLOptionCipherServerPreference != 0 {
+		flags |= C.SSL_OP_CIPHER_SERVER_PREFERENCE
+	}
 
-	c.ctx = C.SSL_CTX_new(meth)
+	if options&SSLOptionNoTicket != 0 {
+		flags |= C.SSL_OP_NO_TICKET
+	}
 
-	if c.ctx == nil {
-		return nil, goifyError("nrpe: cannot create ssl context")
+	if options&SSLOptionNoCompression != 0 {
+		flags |= C.SSL_OP_NO_COMPRESSION
 	}
 
-	// disable ssl2 and ssl3
-	C.SSL_CTX_set_options_func(c.ctx, C.SSL_OP_NO_SSLv2|C.SSL_OP_NO_SSLv3)
+	if options&SSLOptionNoRenegotiation != 0 {
+		flags |= C.SSL_OP_NO_RENEGOTIATION
+	}
 
-	// nrpe supports only Anonymous DH cipher suites
-	C.SSL_CTX_set_cipher_list(c.ctx, C.CString("ADH"))
+	return flags
+}
 
-	C.SSL_CTX_set_tmp_dh_func(c.ctx, dhparam)
+func setCipherList(ctx *C.SSL_CTX, cipherList string) error {
+	cCipherList := C.CString(cipherList)
+	defer C.free(unsafe.Pointer(cCipherList))
 
-	c.ssl = C.SSL_new(c.ctx)
+	if C.SSL_CTX_set_cipher_list(ctx, cCipherList) != 1 {
+		return goifyError("nrpe: cannot set cipher list")
+	}
+
+	return nil
+}
+
+func newSSLConn(conn net.Conn, config *SSLConfig, server bool) (*sslConn, error) {
+	ctx, err := getSSLContext(config, server)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c := &sslConn{
+		Conn:   conn,
+		ctx:    ctx,
+		state:  stateInitial,
+		verify: ctx.verify,
+		server: server,
+		dhBits: ctx.dhBits,
+	}
+
+	c.ssl = C.SSL_new(ctx.ctx)
 
 	if c.ssl == nil {
 		return nil, goifyError("nrpe: cannot create ssl")
@@ -392,19 +868,113 @@ func newSSLServerConn(conn net.Conn) (net.Conn, error) {
 	b := C.BIO_new(C.BIO_s_go_conn())
 
 	if b == nil {
+		c.Clean()
 		return nil, goifyError("nrpe: cannot create BIO")
 	}
 
-	c.ptr = unsafe.Pointer(b)
-	b.ptr = c.ptr
-
-	// we can't pass GO pointer to C, so we will keep ctx in global map
-	// and use it to access ctx from callback functions
-	connMap.add(c.ptr, c)
+	// callbacks get the connection from the BIO, pinning
+	// allows to keep its address in C memory
+	c.pinner.Pin(c)
+	C.nrpe_bio_set_conn(b, C.uintptr_t(uintptr(unsafe.Pointer(c))))
 
 	C.SSL_set_bio(c.ssl, b, b)
 
-	C.SSL_set_accept_state(c.ssl)
+	if server {
+		C.SSL_set_accept_state(c.ssl)
+	} else {
+		C.SSL_set_connect_state(c.ssl)
+	}
+
+	return c, nil
+}
+
+func newSSLClient(conn net.Conn, config *SSLConfig) (sslConnection, error) {
+	c, err := newSSLConn(conn, config, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func newSSLServerConn(conn net.Conn, config *SSLConfig) (sslConnection, error) {
+	c, err := newSSLConn(conn, config, true)
+
+	if err != nil {
+		return nil, err
+	}
 
 	return c, nil
 }
+
+// configureCertificates sets up certificate based ssl on the context
+func configureCertificates(ctx *C.SSL_CTX, config *SSLConfig, server bool) error {
+	if err := config.validate(server); err != nil {
+		return err
+	}
+
+	cipherList := "ALL:!aNULL:!eNULL:!MD5"
+
+	if server && config.ClientCerts == NoClientCert {
+		// anonymous clients are accepted as well
+		cipherList = "ALL:!eNULL:!MD5"
+		C.nrpe_allow_anonymous(ctx)
+	}
+
+	if config.CipherList != "" {
+		cipherList = config.CipherList
+	}
+
+	if err := setCipherList(ctx, cipherList); err != nil {
+		return err
+	}
+
+	if config.CertFile != "" {
+		certFile := C.CString(config.CertFile)
+		defer C.free(unsafe.Pointer(certFile))
+
+		keyFile := C.CString(config.keyFile())
+		defer C.free(unsafe.Pointer(keyFile))
+
+		if C.SSL_CTX_use_certificate_chain_file(ctx, certFile) != 1 {
+			return goifyError("nrpe: cannot load certificate %s", config.CertFile)
+		}
+
+		if C.SSL_CTX_use_PrivateKey_file(ctx, keyFile, C.SSL_FILETYPE_PEM) != 1 {
+			return goifyError("nrpe: cannot load private key %s", config.keyFile())
+		}
+
+		if C.SSL_CTX_check_private_key(ctx) != 1 {
+			return goifyError("nrpe: private key doesn't match certificate")
+		}
+	}
+
+	if config.CAFile != "" {
+		caFile := C.CString(config.CAFile)
+		defer C.free(unsafe.Pointer(caFile))
+
+		if C.SSL_CTX_load_verify_locations(ctx, caFile, nil) != 1 {
+			return goifyError("nrpe: cannot load CA %s", config.CAFile)
+		}
+
+		if server {
+			C.SSL_CTX_set_client_CA_list(ctx, C.SSL_load_client_CA_file(caFile))
+		}
+	}
+
+	mode := C.SSL_VERIFY_NONE
+
+	switch {
+	case !server && config.CAFile != "":
+		mode = C.SSL_VERIFY_PEER
+	case server && config.ClientCerts == RequestClientCert:
+		mode = C.SSL_VERIFY_PEER
+	case server && config.ClientCerts == RequireClientCert:
+		mode = C.SSL_VERIFY_PEER | C.SSL_VERIFY_FAIL_IF_NO_PEER_CERT
+	}
+
+	C.SSL_CTX_set_verify(ctx, C.int(mode), nil)
+
+	return nil
+}
@@ -0,0 +1,241 @@
+//go:build cgo || nrpe_purego
+// +build cgo nrpe_purego
+
+package nrpe
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestClientServerCertificates(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	client := &Client{SSL: &SSLConfig{CAFile: certs.ca}}
+	server := &Server{SSL: &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey}}
+
+	result, serverState, err, serverErr := testRunWithConfig(t, client, server)
+
+	if err != nil || serverErr != nil {
+		t.Fatal(err, serverErr)
+	}
+
+	if !result.SSL.Verified || result.SSL.PeerCertificate.Subject.CommonName != "server" {
+		t.Fatal("Expected verified server certificate")
+	}
+
+	if serverState == nil || serverState.PeerCertificate != nil {
+		t.Fatal("Expected ssl state without client certificate")
+	}
+}
+
+func TestClientServerMutualAuthentication(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	client := &Client{SSL: &SSLConfig{CertFile: certs.clientCert, KeyFile: certs.clientKey, CAFile: certs.ca}}
+	server := &Server{SSL: &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey,
+		CAFile: certs.ca, ClientCerts: RequireClientCert}}
+
+	result, serverState, err, serverErr := testRunWithConfig(t, client, server)
+
+	if err != nil || serverErr != nil {
+		t.Fatal(err, serverErr)
+	}
+
+	if !result.SSL.Verified {
+		t.Fatal("Expected verified server certificate")
+	}
+
+	if !serverState.Verified || serverState.PeerCertificate.Subject.CommonName != "client" {
+		t.Fatal("Expected verified client certificate")
+	}
+}
+
+func TestClientServerOptionalClientCert(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	client := &Client{SSL: &SSLConfig{CAFile: certs.ca}}
+	server := &Server{SSL: &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey,
+		CAFile: certs.ca, ClientCerts: RequestClientCert}}
+
+	_, serverState, err, serverErr := testRunWithConfig(t, client, server)
+
+	if err != nil || serverErr != nil {
+		t.Fatal(err, serverErr)
+	}
+
+	if serverState.PeerCertificate != nil || serverState.Verified {
+		t.Fatal("Expected no client certificate")
+	}
+}
+
+func TestClientServerRequiredClientCertMissing(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	client := &Client{SSL: &SSLConfig{CAFile: certs.ca}}
+	server := &Server{SSL: &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey,
+		CAFile: certs.ca, ClientCerts: RequireClientCert}}
+
+	if _, _, err, serverErr := testRunWithConfig(t, client, server); err == nil || serverErr == nil {
+		t.Fatal("Expected handshake error")
+	}
+}
+
+func TestClientServerUntrustedServer(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	client := &Client{SSL: &SSLConfig{CAFile: certs.otherCA}}
+	server := &Server{SSL: &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey}}
+
+	if _, _, err, serverErr := testRunWithConfig(t, client, server); err == nil || serverErr == nil {
+		t.Fatal("Expected handshake error")
+	}
+}
+
+func TestSSLSharedConfigConcurrent(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	clientConfig := &SSLConfig{CAFile: certs.ca}
+	serverConfig := &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sock := testCreateSocketPair(t)
+			defer sock.Close()
+
+			client, err := newSSLClient(sock.client, clientConfig)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer client.Clean()
+
+			server, err := newSSLServerConn(sock.server, serverConfig)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer server.Clean()
+
+			c := make(chan error)
+
+			go func() {
+				_, err := server.Read(make([]byte, 4))
+				c <- err
+			}()
+
+			if _, err = client.Write([]byte("ping")); err != nil {
+				t.Error(err)
+			}
+
+			if err = <-c; err != nil {
+				t.Error(err)
+			}
+
+			if !client.sslState().Verified {
+				t.Error("Expected verified server certificate")
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestClientServerConnectionState(t *testing.T) {
+	client := &Client{SSL: &SSLConfig{}}
+	server := &Server{SSL: &SSLConfig{DHGroup: DHGroupFFDHE3072}}
+
+	result, serverState, err, serverErr := testRunWithConfig(t, client, server)
+
+	if err != nil || serverErr != nil {
+		t.Fatal(err, serverErr)
+	}
+
+	for _, state := range []*ConnectionState{result.SSL, serverState} {
+		if state.Version != VersionTLS12 || state.DHBits != 3072 || state.HandshakeDuration <= 0 {
+			t.Fatalf("Unexpected state %+v", state)
+		}
+
+		if state.CipherSuiteName() != "TLS_DH_anon_WITH_AES_256_GCM_SHA384" {
+			t.Fatalf("Unexpected cipher suite %s", state.CipherSuiteName())
+		}
+	}
+
+	certs := testCreateCertificates(t)
+
+	client = &Client{SSL: &SSLConfig{CAFile: certs.ca, MaxVersion: VersionTLS12}}
+	server = &Server{SSL: &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey}}
+
+	result, serverState, err, serverErr = testRunWithConfig(t, client, server)
+
+	if err != nil || serverErr != nil {
+		t.Fatal(err, serverErr)
+	}
+
+	// ECDSA certificates use ECDHE key exchange
+	for _, state := range []*ConnectionState{result.SSL, serverState} {
+		if state.Version != VersionTLS12 || state.DHBits != 0 || state.CipherSuite == 0 {
+			t.Fatalf("Unexpected state %+v", state)
+		}
+	}
+}
+
+func TestSSLConfigErrors(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	configs := []*SSLConfig{
+		{CertFile: certs.serverCert, KeyFile: certs.serverKey, ClientCerts: RequireClientCert},
+		{CertFile: certs.serverCert, KeyFile: certs.clientKey},
+		{CertFile: "/nonexistent"},
+		{CertFile: certs.serverCert, KeyFile: certs.serverKey, CAFile: "/nonexistent"},
+	}
+
+	for i, config := range configs {
+		sock := testCreateSocketPair(t)
+		defer sock.Close()
+
+		if _, err := newSSLServerConn(sock.server, config); err == nil {
+			t.Fatalf("Expected error for config %d", i)
+		}
+	}
+}
+
+func TestSSLIndependentConfigs(t *testing.T) {
+	configs := map[int]*SSLConfig{
+		2048: {DHGroup: DHGroupFFDHE2048},
+		3072: {DHGroup: DHGroupFFDHE3072},
+	}
+
+	var wg sync.WaitGroup
+
+	for bits, config := range configs {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			result, _, err, serverErr := testRunWithConfig(t, &Client{SSL: &SSLConfig{}}, &Server{SSL: config})
+
+			if err != nil || serverErr != nil {
+				t.Error(err, serverErr)
+				return
+			}
+
+			if result.SSL.DHBits != bits {
+				t.Errorf("Expected %d DH bits, got %d", bits, result.SSL.DHBits)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
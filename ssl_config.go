@@ -0,0 +1,217 @@
+package nrpe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientCertMode defines whether the server asks for client certificates
+type ClientCertMode int
+
+const (
+	// NoClientCert doesn't request client certificate
+	NoClientCert ClientCertMode = iota
+	// RequestClientCert requests client certificate and verifies it if sent
+	RequestClientCert
+	// RequireClientCert fails the handshake without valid client certificate
+	RequireClientCert
+)
+
+// SSLConfig holds ssl settings of a client or a server.
+// Zero value means anonymous DH, which is what nrpe uses by default.
+// Certificate based ssl is used by the server if CertFile is set
+// and by the client if either CertFile or CAFile is set.
+//
+// SSL context is created on first use and shared by all connections
+// using the config, so the config is safe for concurrent use but must
+// not be modified or copied afterwards.
+type SSLConfig struct {
+	// CertFile is PEM file with own certificate chain
+	CertFile string
+	// KeyFile is PEM file with private key, defaults to CertFile
+	KeyFile string
+	// CAFile is PEM file with certificates used to verify the peer,
+	// the client doesn't verify the server if it's empty
+	CAFile string
+	// ClientCerts defines client certificate policy of the server
+	ClientCerts ClientCertMode
+	// DHParamsFile is PEM file with DH parameters of the server,
+	// as generated by openssl dhparam, DHGroup is used if it's empty
+	DHParamsFile string
+	// DHGroup selects well-known DH group of the server
+	DHGroup DHGroup
+	// CipherList is OpenSSL cipher list, "ADH" is used for anonymous
+	// DH by default. The pure go implementation understands only
+	// names of the suites it implements (IANA names for certificates).
+	CipherList string
+	// MinVersion is the minimum protocol version, zero means no limit
+	MinVersion SSLVersion
+	// MaxVersion is the maximum protocol version, zero means no limit.
+	// Anonymous DH is limited to TLS 1.2 as TLS 1.3 has no such suites.
+	MaxVersion SSLVersion
+	// Options are additional flags of the ssl context
+	Options SSLOptions
+
+	lock     sync.Mutex
+	contexts map[sslContextKey]*sslContextEntry
+}
+
+// anonymousSSLConfig is shared by connections without explicit config
+var anonymousSSLConfig = &SSLConfig{}
+
+// sslContextKey identifies cached context of ssl implementation
+type sslContextKey struct {
+	impl   string
+	server bool
+}
+
+type sslContextEntry struct {
+	lock  sync.Mutex
+	value interface{}
+}
+
+// ConnectionState describes established ssl connection
+type ConnectionState struct {
+	// Version is the negotiated protocol version
+	Version SSLVersion
+	// CipherSuite is IANA id of the negotiated cipher suite
+	CipherSuite uint16
+	// DHBits is the size of DH prime if DH key exchange was used
+	DHBits int
+	// HandshakeDuration is how long the handshake took
+	HandshakeDuration time.Duration
+	// PeerCertificate is the certificate sent by the peer, if any
+	PeerCertificate *x509.Certificate
+	// Verified is set if the peer certificate was verified against CAFile
+	Verified bool
+}
+
+// ids of the anonymous DH cipher suites of the pure go ssl
+const (
+	adhCipherSuiteAES256 = 0x00a7
+	adhCipherSuiteAES128 = 0x00a6
+)
+
+// adhCipherSuiteNames maps OpenSSL and IANA names to suites
+var adhCipherSuiteNames = map[string]uint16{
+	"ADH-AES256-GCM-SHA384":               adhCipherSuiteAES256,
+	"TLS_DH_anon_WITH_AES_256_GCM_SHA384": adhCipherSuiteAES256,
+	"ADH-AES128-GCM-SHA256":               adhCipherSuiteAES128,
+	"TLS_DH_anon_WITH_AES_128_GCM_SHA256": adhCipherSuiteAES128,
+}
+
+// CipherSuiteName returns IANA name of the cipher suite,
+// hex id if the name isn't known
+func (s *ConnectionState) CipherSuiteName() string {
+	for name, id := range adhCipherSuiteNames {
+		if id == s.CipherSuite && strings.HasPrefix(name, "TLS_") {
+			return name
+		}
+	}
+
+	return tls.CipherSuiteName(s.CipherSuite)
+}
+
+type connectionStateKey struct{}
+
+// ConnectionStateFromContext returns ssl state of the connection
+// the handler is serving, nil for plain connections
+func ConnectionStateFromContext(ctx context.Context) *ConnectionState {
+	state, _ := ctx.Value(connectionStateKey{}).(*ConnectionState)
+	return state
+}
+
+func contextWithConnectionState(ctx context.Context, state *ConnectionState) context.Context {
+	return context.WithValue(ctx, connectionStateKey{}, state)
+}
+
+// certificateMode reports whether certificates are used instead of anonymous DH
+func (c *SSLConfig) certificateMode(server bool) bool {
+	if server {
+		return c.CertFile != ""
+	}
+
+	return c.CertFile != "" || c.CAFile != ""
+}
+
+func (c *SSLConfig) keyFile() string {
+	if c.KeyFile == "" {
+		return c.CertFile
+	}
+
+	return c.KeyFile
+}
+
+// versions returns protocol version range, anonymous DH
+// is limited to TLS 1.2
+func (c *SSLConfig) versions(anonymous bool) (min, max SSLVersion, err error) {
+	min, max = c.MinVersion, c.MaxVersion
+
+	if anonymous && (max == 0 || max > VersionTLS12) {
+		max = VersionTLS12
+	}
+
+	if max != 0 && min > max {
+		return 0, 0, fmt.Errorf("nrpe: no ssl version between %s and %s", min, max)
+	}
+
+	return min, max, nil
+}
+
+func (c *SSLConfig) validate(server bool) error {
+	if !server || c.ClientCerts == NoClientCert {
+		return nil
+	}
+
+	if c.CertFile == "" {
+		return fmt.Errorf("nrpe: client certificates require server certificate")
+	}
+
+	if c.CAFile == "" {
+		return fmt.Errorf("nrpe: client certificates require CAFile")
+	}
+
+	return nil
+}
+
+// context returns cached context for the key, creating it on first use.
+// Failed attempts aren't cached, so fixed files are picked up later.
+// Entries are locked separately, so create may request other keys.
+func (c *SSLConfig) context(key sslContextKey, create func() (interface{}, error)) (interface{}, error) {
+	c.lock.Lock()
+
+	if c.contexts == nil {
+		c.contexts = make(map[sslContextKey]*sslContextEntry)
+	}
+
+	entry := c.contexts[key]
+
+	if entry == nil {
+		entry = &sslContextEntry{}
+		c.contexts[key] = entry
+	}
+
+	c.lock.Unlock()
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.value != nil {
+		return entry.value, nil
+	}
+
+	value, err := create()
+
+	if err != nil {
+		return nil, err
+	}
+
+	entry.value = value
+
+	return value, nil
+}
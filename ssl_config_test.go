@@ -0,0 +1,22 @@
+package nrpe
+
+import (
+	"testing"
+)
+
+func TestConnectionStateCipherSuiteName(t *testing.T) {
+	tests := map[uint16]string{
+		adhCipherSuiteAES256: "TLS_DH_anon_WITH_AES_256_GCM_SHA384",
+		adhCipherSuiteAES128: "TLS_DH_anon_WITH_AES_128_GCM_SHA256",
+		0x1301:               "TLS_AES_128_GCM_SHA256",
+		0x009f:               "0x009F",
+	}
+
+	for id, name := range tests {
+		state := &ConnectionState{CipherSuite: id}
+
+		if state.CipherSuiteName() != name {
+			t.Fatalf("Expected %s, got %s", name, state.CipherSuiteName())
+		}
+	}
+}
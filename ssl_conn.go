@@ -0,0 +1,93 @@
+package nrpe
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SSLConn is an ssl connection over net.Conn, it allows to run
+// the handshake explicitly and to inspect the established connection
+type SSLConn struct {
+	conn sslConnection
+}
+
+// NewSSLClient wraps conn into the client side of ssl connection,
+// nil config means anonymous DH. ErrSSLUnsupported is returned
+// by builds without ssl.
+func NewSSLClient(conn net.Conn, config *SSLConfig) (*SSLConn, error) {
+	c, err := newSSLClient(conn, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSLConn{c}, nil
+}
+
+// NewSSLServer wraps conn into the server side of ssl connection
+func NewSSLServer(conn net.Conn, config *SSLConfig) (*SSLConn, error) {
+	c, err := newSSLServerConn(conn, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SSLConn{c}, nil
+}
+
+// Handshake runs the handshake unless it's already done, cancellation
+// of ctx interrupts it. Read and Write run it implicitly.
+func (c *SSLConn) Handshake(ctx context.Context) error {
+	return c.conn.Handshake(ctx)
+}
+
+// ConnectionState returns state of the connection, it's empty
+// until the handshake is done
+func (c *SSLConn) ConnectionState() *ConnectionState {
+	return c.conn.sslState()
+}
+
+func (c *SSLConn) Read(b []byte) (int, error) {
+	return c.conn.Read(b)
+}
+
+func (c *SSLConn) Write(b []byte) (int, error) {
+	return c.conn.Write(b)
+}
+
+// Close sends close_notify if the handshake is done and closes
+// the underlying connection
+func (c *SSLConn) Close() error {
+	return c.conn.Close()
+}
+
+// Clean releases ssl resources without closing the underlying connection
+func (c *SSLConn) Clean() {
+	c.conn.Clean()
+}
+
+// LocalAddr returns local address of the underlying connection
+func (c *SSLConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns remote address of the underlying connection
+func (c *SSLConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets deadlines of the underlying connection
+func (c *SSLConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets read deadline of the underlying connection
+func (c *SSLConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets write deadline of the underlying connection
+func (c *SSLConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
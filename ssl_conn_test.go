@@ -0,0 +1,95 @@
+//go:build cgo || nrpe_purego
+// +build cgo nrpe_purego
+
+package nrpe
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSSLConnHandshake(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	server, err := NewSSLServer(sock.server, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Clean()
+
+	client, err := NewSSLClient(sock.client, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		if err := server.Handshake(ctx); err != nil {
+			done <- err
+			return
+		}
+
+		_, err := server.Write([]byte("ping"))
+		done <- err
+	}()
+
+	if err = client.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := client.ConnectionState(); state.Version == 0 || state.CipherSuite == 0 {
+		t.Fatalf("Expected negotiated connection state, got %+v", state)
+	}
+
+	buf := make([]byte, 4)
+
+	if _, err = io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "ping" {
+		t.Fatalf("Expected ping, got %q", buf)
+	}
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// repeated handshake is a no-op
+	if err = client.Handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSLConnHandshakeContext(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	server, err := NewSSLServer(sock.server, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Clean()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// nobody talks to the server
+	if err = server.Handshake(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error, got %v", err)
+	}
+}
@@ -0,0 +1,978 @@
+//go:build cgo || nrpe_purego
+// +build cgo nrpe_purego
+
+package nrpe
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Pure go implementation of the TLS subset nrpe relies on:
+// TLS 1.2 with anonymous Diffie-Hellman key exchange and AES-GCM,
+// which is what OpenSSL negotiates for the "ADH" cipher list.
+// crypto/tls doesn't implement anonymous cipher suites.
+
+const (
+	tlsVersion12         = 0x0303
+	tlsMaxPlaintext      = 16384
+	tlsMaxRecordBytes    = tlsMaxPlaintext + 2048
+	tlsRandomLength      = 32
+	tlsVerifyLength      = 12
+	tlsMasterLength      = 48
+	tlsGCMNonceLength    = 8
+	tlsGCMIVLength       = 4
+	tlsMaxHandshakeBytes = 1 << 16 // limit of buffered handshake messages
+)
+
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeApplicationData  = 23
+)
+
+const (
+	handshakeTypeClientHello       = 1
+	handshakeTypeServerHello       = 2
+	handshakeTypeServerKeyExchange = 12
+	handshakeTypeServerHelloDone   = 14
+	handshakeTypeClientKeyExchange = 16
+	handshakeTypeFinished          = 20
+)
+
+const (
+	alertLevelWarning      = 1
+	alertLevelFatal        = 2
+	alertCloseNotify       = 0
+	alertHandshakeFailure  = 40
+	scsvRenegotiationInfo  = 0x00ff
+	extRenegotiationInfo   = 0xff01
+	minDHPrimeBits         = 512
+	adhFinishedLabelClient = "client finished"
+	adhFinishedLabelServer = "server finished"
+)
+
+type adhCipherSuite struct {
+	id     uint16
+	keyLen int
+	hash   func() hash.Hash
+}
+
+// adhCipherSuites lists supported cipher suites in order of preference
+var adhCipherSuites = []adhCipherSuite{
+	// TLS_DH_anon_WITH_AES_256_GCM_SHA384
+	{adhCipherSuiteAES256, 32, sha512.New384},
+	// TLS_DH_anon_WITH_AES_128_GCM_SHA256
+	{adhCipherSuiteAES128, 16, sha256.New},
+}
+
+func adhCipherSuiteByID(id uint16) *adhCipherSuite {
+	for i := range adhCipherSuites {
+		if adhCipherSuites[i].id == id {
+			return &adhCipherSuites[i]
+		}
+	}
+	return nil
+}
+
+// adhCipherSuitesFromList returns suites selected by the cipher list
+func adhCipherSuitesFromList(list string) ([]adhCipherSuite, error) {
+	if list == "" {
+		return adhCipherSuites, nil
+	}
+
+	all := make([]uint16, len(adhCipherSuites))
+
+	for i, s := range adhCipherSuites {
+		all[i] = s.id
+	}
+
+	ids, err := selectCipherSuites(list, adhCipherSuiteNames, all)
+
+	if err != nil {
+		return nil, err
+	}
+
+	suites := make([]adhCipherSuite, len(ids))
+
+	for i, id := range ids {
+		suites[i] = *adhCipherSuiteByID(id)
+	}
+
+	return suites, nil
+}
+
+// adhAlert is an alert received from the peer
+type adhAlert uint8
+
+func (a adhAlert) Error() string {
+	return fmt.Sprintf("nrpe: received ssl alert %d", uint8(a))
+}
+
+// adhHalfConn holds record protection state of one direction
+type adhHalfConn struct {
+	aead cipher.AEAD
+	iv   []byte
+	seq  uint64
+}
+
+func (h *adhHalfConn) setKey(key, iv []byte) error {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return err
+	}
+
+	h.aead = aead
+	h.iv = iv
+	h.seq = 0
+
+	return nil
+}
+
+func (h *adhHalfConn) additionalData(recordType byte, length int) []byte {
+	ad := make([]byte, 13)
+
+	binary.BigEndian.PutUint64(ad, h.seq)
+	ad[8] = recordType
+	binary.BigEndian.PutUint16(ad[9:], tlsVersion12)
+	binary.BigEndian.PutUint16(ad[11:], uint16(length))
+
+	return ad
+}
+
+// seal encrypts record payload, explicit nonce is the sequence number
+func (h *adhHalfConn) seal(recordType byte, data []byte) []byte {
+	if h.aead == nil {
+		return data
+	}
+
+	nonce := make([]byte, tlsGCMIVLength+tlsGCMNonceLength)
+	copy(nonce, h.iv)
+	binary.BigEndian.PutUint64(nonce[tlsGCMIVLength:], h.seq)
+
+	out := h.aead.Seal(nonce[tlsGCMIVLength:], nonce, data,
+		h.additionalData(recordType, len(data)))
+
+	h.seq++
+
+	return out
+}
+
+func (h *adhHalfConn) open(recordType byte, data []byte) ([]byte, error) {
+	if h.aead == nil {
+		return data, nil
+	}
+
+	if len(data) < tlsGCMNonceLength+h.aead.Overhead() {
+		return nil, fmt.Errorf("nrpe: ssl record is too short")
+	}
+
+	nonce := make([]byte, tlsGCMIVLength+tlsGCMNonceLength)
+	copy(nonce, h.iv)
+	copy(nonce[tlsGCMIVLength:], data[:tlsGCMNonceLength])
+
+	data = data[tlsGCMNonceLength:]
+
+	out, err := h.aead.Open(nil, nonce, data,
+		h.additionalData(recordType, len(data)-h.aead.Overhead()))
+
+	if err != nil {
+		return nil, fmt.Errorf("nrpe: ssl record authentication failed")
+	}
+
+	h.seq++
+
+	return out, nil
+}
+
+type goSSLConn struct {
+	net.Conn
+	isClient bool
+	dhPrime  *big.Int
+	dhGen    *big.Int
+
+	handshakeLock sync.Mutex
+	handshakeDone atomic.Bool
+	// handshakeDuration is set once the handshake is done
+	handshakeDuration time.Duration
+	closeNotified     atomic.Bool
+	handshakeErr      error
+
+	inLock       sync.Mutex
+	in           adhHalfConn
+	input        []byte
+	handshakeBuf []byte
+	readErr      error
+
+	outLock sync.Mutex
+	out     adhHalfConn
+
+	// suites enabled by the config, all of them if nil
+	suites       []adhCipherSuite
+	suite        *adhCipherSuite
+	transcript   bytes.Buffer
+	clientRandom []byte
+	serverRandom []byte
+	masterSecret []byte
+}
+
+// Handshake runs the ssl handshake unless it has already been done,
+// cancellation of ctx interrupts it. Read and Write call it implicitly.
+func (c *goSSLConn) Handshake(ctx context.Context) error {
+	return handshakeContext(ctx, c.Conn, c.handshake)
+}
+
+func (c *goSSLConn) handshake() error {
+	c.handshakeLock.Lock()
+	defer c.handshakeLock.Unlock()
+
+	if c.handshakeDone.Load() || c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+
+	var err error
+
+	start := time.Now()
+
+	if c.isClient {
+		err = c.clientHandshake()
+	} else {
+		err = c.serverHandshake()
+	}
+
+	c.handshakeDuration = time.Since(start)
+
+	if err != nil {
+		if _, ok := err.(adhAlert); !ok {
+			c.sendAlert(alertLevelFatal, alertHandshakeFailure)
+		}
+
+		c.handshakeErr = fmt.Errorf("nrpe: error on ssl handshake: %w", err)
+
+		return c.handshakeErr
+	}
+
+	c.handshakeDone.Store(true)
+
+	// handshake state isn't needed anymore
+	c.transcript = bytes.Buffer{}
+
+	return nil
+}
+
+// Clean does nothing, go ssl connection holds no native resources
+func (c *goSSLConn) Clean() {
+}
+
+// sslState returns state of the anonymous connection, there are no certificates
+func (c *goSSLConn) sslState() *ConnectionState {
+	if !c.handshakeDone.Load() {
+		return &ConnectionState{}
+	}
+
+	return &ConnectionState{
+		Version:           VersionTLS12,
+		CipherSuite:       c.suite.id,
+		DHBits:            c.dhPrime.BitLen(),
+		HandshakeDuration: c.handshakeDuration,
+	}
+}
+
+// Close sends close_notify alert once and closes underlying connection
+func (c *goSSLConn) Close() error {
+	if c.handshakeDone.Load() && !c.closeNotified.Swap(true) {
+		c.sendAlert(alertLevelWarning, alertCloseNotify)
+	}
+
+	return c.Conn.Close()
+}
+
+func (c *goSSLConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	c.inLock.Lock()
+	defer c.inLock.Unlock()
+
+	for len(c.input) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		recordType, data, err := c.readRecord()
+
+		if err != nil {
+			c.readErr = err
+			return 0, err
+		}
+
+		switch recordType {
+		case recordTypeApplicationData:
+			c.input = data
+		case recordTypeAlert:
+			c.readErr = c.handleAlert(data)
+		case recordTypeHandshake:
+			// renegotiation is not supported, requests are ignored
+		default:
+			c.readErr = fmt.Errorf("nrpe: unexpected ssl record type %d", recordType)
+		}
+	}
+
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+
+	return n, nil
+}
+
+func (c *goSSLConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+
+	return c.writeRecord(recordTypeApplicationData, b)
+}
+
+// handleAlert returns io.EOF for close_notify, nil for other warnings
+func (c *goSSLConn) handleAlert(data []byte) error {
+	if len(data) != 2 {
+		return fmt.Errorf("nrpe: invalid ssl alert")
+	}
+
+	if data[1] == alertCloseNotify {
+		return io.EOF
+	}
+
+	if data[0] == alertLevelWarning {
+		return nil
+	}
+
+	return adhAlert(data[1])
+}
+
+func (c *goSSLConn) sendAlert(level, description byte) {
+	c.outLock.Lock()
+	c.writeRecord(recordTypeAlert, []byte{level, description})
+	c.outLock.Unlock()
+}
+
+// readRecord reads and decrypts one record, called with inLock held
+// or during the handshake
+func (c *goSSLConn) readRecord() (byte, []byte, error) {
+	header := make([]byte, 5)
+
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:]))
+
+	if header[1] != 3 || length > tlsMaxRecordBytes {
+		return 0, nil, fmt.Errorf("nrpe: invalid ssl record")
+	}
+
+	data := make([]byte, length)
+
+	if _, err := io.ReadFull(c.Conn, data); err != nil {
+		return 0, nil, err
+	}
+
+	data, err := c.in.open(header[0], data)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], data, nil
+}
+
+// writeRecord encrypts and writes data, split into records of allowed size
+func (c *goSSLConn) writeRecord(recordType byte, data []byte) (int, error) {
+	n := 0
+
+	for {
+		chunk := data[n:]
+
+		if len(chunk) > tlsMaxPlaintext {
+			chunk = chunk[:tlsMaxPlaintext]
+		}
+
+		payload := c.out.seal(recordType, chunk)
+
+		record := make([]byte, 5, 5+len(payload))
+		record[0] = recordType
+		binary.BigEndian.PutUint16(record[1:], tlsVersion12)
+		binary.BigEndian.PutUint16(record[3:], uint16(len(payload)))
+		record = append(record, payload...)
+
+		l, err := c.Conn.Write(record)
+
+		if err != nil {
+			return n, err
+		}
+
+		if l != len(record) {
+			return n, fmt.Errorf("nrpe: error while writing")
+		}
+
+		n += len(chunk)
+
+		if n >= len(data) {
+			return n, nil
+		}
+	}
+}
+
+// readHandshake reads next handshake message of the expected type
+// and adds it to the transcript
+func (c *goSSLConn) readHandshake(expected byte) ([]byte, error) {
+	for {
+		if len(c.handshakeBuf) >= 4 {
+			length := int(be24(c.handshakeBuf[1:]))
+
+			if length > tlsMaxHandshakeBytes {
+				return nil, fmt.Errorf("handshake message too long: %d bytes", length)
+			}
+
+			if len(c.handshakeBuf) >= 4+length {
+				break
+			}
+		}
+
+		recordType, data, err := c.readRecord()
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch recordType {
+		case recordTypeHandshake:
+			c.handshakeBuf = append(c.handshakeBuf, data...)
+		case recordTypeAlert:
+			if err = c.handleAlert(data); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected record type %d", recordType)
+		}
+	}
+
+	length := 4 + int(be24(c.handshakeBuf[1:]))
+
+	msg := c.handshakeBuf[:length]
+	c.handshakeBuf = c.handshakeBuf[length:]
+
+	if msg[0] != expected {
+		return nil, fmt.Errorf("unexpected message %d, expected %d", msg[0], expected)
+	}
+
+	c.transcript.Write(msg)
+
+	return msg[4:], nil
+}
+
+// writeHandshake writes handshake messages within one record
+func (c *goSSLConn) writeHandshake(msgs ...[]byte) error {
+	var flight []byte
+
+	for _, msg := range msgs {
+		c.transcript.Write(msg)
+		flight = append(flight, msg...)
+	}
+
+	_, err := c.writeRecord(recordTypeHandshake, flight)
+
+	return err
+}
+
+func (c *goSSLConn) readChangeCipherSpec() error {
+	recordType, data, err := c.readRecord()
+
+	if err != nil {
+		return err
+	}
+
+	if recordType == recordTypeAlert {
+		if err = c.handleAlert(data); err == nil {
+			err = fmt.Errorf("unexpected alert")
+		}
+		return err
+	}
+
+	if recordType != recordTypeChangeCipherSpec ||
+		!bytes.Equal(data, []byte{1}) || len(c.handshakeBuf) != 0 {
+
+		return fmt.Errorf("expected change cipher spec")
+	}
+
+	return nil
+}
+
+// establishKeys derives master secret and record protection keys
+func (c *goSSLConn) establishKeys(preMasterSecret []byte) (client, server *adhHalfConn, err error) {
+	h := c.suite.hash
+
+	c.masterSecret = adhPRF(h, preMasterSecret, "master secret",
+		concat(c.clientRandom, c.serverRandom), tlsMasterLength)
+
+	k := c.suite.keyLen
+
+	keys := adhPRF(h, c.masterSecret, "key expansion",
+		concat(c.serverRandom, c.clientRandom), 2*k+2*tlsGCMIVLength)
+
+	client = &adhHalfConn{}
+	server = &adhHalfConn{}
+
+	if err = client.setKey(keys[:k], keys[2*k:2*k+tlsGCMIVLength]); err != nil {
+		return nil, nil, err
+	}
+
+	if err = server.setKey(keys[k:2*k], keys[2*k+tlsGCMIVLength:]); err != nil {
+		return nil, nil, err
+	}
+
+	return client, server, nil
+}
+
+func (c *goSSLConn) finishedMessage(label string) []byte {
+	h := c.suite.hash()
+	h.Write(c.transcript.Bytes())
+
+	return handshakeMessage(handshakeTypeFinished,
+		adhPRF(c.suite.hash, c.masterSecret, label, h.Sum(nil), tlsVerifyLength))
+}
+
+// sendFinished sends change cipher spec followed by encrypted finished
+func (c *goSSLConn) sendFinished(out *adhHalfConn, label string) error {
+	if _, err := c.writeRecord(recordTypeChangeCipherSpec, []byte{1}); err != nil {
+		return err
+	}
+
+	c.out = *out
+
+	return c.writeHandshake(c.finishedMessage(label))
+}
+
+// readFinished reads change cipher spec and verifies peer's finished
+func (c *goSSLConn) readFinished(in *adhHalfConn, label string) error {
+	if err := c.readChangeCipherSpec(); err != nil {
+		return err
+	}
+
+	c.in = *in
+
+	expected := c.finishedMessage(label)
+
+	msg, err := c.readHandshake(handshakeTypeFinished)
+
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(msg, expected[4:]) {
+		return fmt.Errorf("finished verification failed")
+	}
+
+	return nil
+}
+
+func (c *goSSLConn) enabledSuites() []adhCipherSuite {
+	if c.suites == nil {
+		return adhCipherSuites
+	}
+	return c.suites
+}
+
+func (c *goSSLConn) enabledSuite(id uint16) *adhCipherSuite {
+	suites := c.enabledSuites()
+
+	for i := range suites {
+		if suites[i].id == id {
+			return &suites[i]
+		}
+	}
+	return nil
+}
+
+func (c *goSSLConn) clientHandshake() error {
+	c.clientRandom = make([]byte, tlsRandomLength)
+
+	if _, err := rand.Read(c.clientRandom); err != nil {
+		return err
+	}
+
+	hello := newHandshakeBuilder()
+	hello.uint16(tlsVersion12)
+	hello.bytes(c.clientRandom)
+	hello.uint8(0) // no session id
+
+	suites := newHandshakeBuilder()
+	for _, s := range c.enabledSuites() {
+		suites.uint16(s.id)
+	}
+	suites.uint16(scsvRenegotiationInfo)
+
+	hello.uint16(uint16(len(suites.data)))
+	hello.bytes(suites.data)
+	hello.bytes([]byte{1, 0}) // null compression only
+
+	if err := c.writeHandshake(handshakeMessage(handshakeTypeClientHello, hello.data)); err != nil {
+		return err
+	}
+
+	msg, err := c.readHandshake(handshakeTypeServerHello)
+
+	if err != nil {
+		return err
+	}
+
+	r := handshakeReader(msg)
+
+	if r.uint16() != tlsVersion12 {
+		return fmt.Errorf("unsupported protocol version")
+	}
+
+	c.serverRandom = r.next(tlsRandomLength)
+	r.vector(1) // session id
+	c.suite = c.enabledSuite(r.uint16())
+
+	if r.uint8() != 0 || r.err != nil || c.suite == nil {
+		return fmt.Errorf("invalid server hello")
+	}
+
+	if msg, err = c.readHandshake(handshakeTypeServerKeyExchange); err != nil {
+		return err
+	}
+
+	r = handshakeReader(msg)
+
+	p := new(big.Int).SetBytes(r.vector(2))
+	g := new(big.Int).SetBytes(r.vector(2))
+	ys := new(big.Int).SetBytes(r.vector(2))
+
+	if r.err != nil || len(r.data) != 0 {
+		return fmt.Errorf("invalid server key exchange")
+	}
+
+	if err = validateDHParams(p, g, ys); err != nil {
+		return err
+	}
+
+	c.dhPrime = p
+
+	if _, err = c.readHandshake(handshakeTypeServerHelloDone); err != nil {
+		return err
+	}
+
+	x, err := dhPrivateKey(p)
+
+	if err != nil {
+		return err
+	}
+
+	kx := newHandshakeBuilder()
+	kx.vector(2, new(big.Int).Exp(g, x, p).Bytes())
+
+	if err = c.writeHandshake(handshakeMessage(handshakeTypeClientKeyExchange, kx.data)); err != nil {
+		return err
+	}
+
+	client, server, err := c.establishKeys(new(big.Int).Exp(ys, x, p).Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	if err = c.sendFinished(client, adhFinishedLabelClient); err != nil {
+		return err
+	}
+
+	return c.readFinished(server, adhFinishedLabelServer)
+}
+
+func (c *goSSLConn) serverHandshake() error {
+	msg, err := c.readHandshake(handshakeTypeClientHello)
+
+	if err != nil {
+		return err
+	}
+
+	r := handshakeReader(msg)
+
+	version := r.uint16()
+	c.clientRandom = r.next(tlsRandomLength)
+	r.vector(1) // session id
+	suites := handshakeReader(r.vector(2))
+	compressions := r.vector(1)
+
+	if r.err != nil || suites.err != nil {
+		return fmt.Errorf("invalid client hello")
+	}
+
+	if version < tlsVersion12 {
+		return fmt.Errorf("unsupported protocol version")
+	}
+
+	secureRenegotiation := false
+
+	offered := make(map[uint16]bool)
+
+	for len(suites.data) >= 2 {
+		offered[suites.uint16()] = true
+	}
+
+	if offered[scsvRenegotiationInfo] {
+		secureRenegotiation = true
+	}
+
+	if len(r.data) > 0 {
+		extensions := handshakeReader(r.vector(2))
+
+		for len(extensions.data) > 0 && extensions.err == nil {
+			if extensions.uint16() == extRenegotiationInfo {
+				secureRenegotiation = true
+			}
+			extensions.vector(2)
+		}
+	}
+
+	for _, suite := range c.enabledSuites() {
+		if offered[suite.id] {
+			c.suite = c.enabledSuite(suite.id)
+			break
+		}
+	}
+
+	if c.suite == nil || bytes.IndexByte(compressions, 0) == -1 {
+		return fmt.Errorf("no shared cipher")
+	}
+
+	c.serverRandom = make([]byte, tlsRandomLength)
+
+	if _, err = rand.Read(c.serverRandom); err != nil {
+		return err
+	}
+
+	hello := newHandshakeBuilder()
+	hello.uint16(tlsVersion12)
+	hello.bytes(c.serverRandom)
+	hello.uint8(0) // no session id
+	hello.uint16(c.suite.id)
+	hello.uint8(0) // null compression
+
+	if secureRenegotiation {
+		// empty renegotiated_connection for the initial handshake
+		hello.bytes([]byte{0, 5, 0xff, 0x01, 0, 1, 0})
+	}
+
+	y, err := dhPrivateKey(c.dhPrime)
+
+	if err != nil {
+		return err
+	}
+
+	kx := newHandshakeBuilder()
+	kx.vector(2, c.dhPrime.Bytes())
+	kx.vector(2, c.dhGen.Bytes())
+	kx.vector(2, new(big.Int).Exp(c.dhGen, y, c.dhPrime).Bytes())
+
+	err = c.writeHandshake(
+		handshakeMessage(handshakeTypeServerHello, hello.data),
+		handshakeMessage(handshakeTypeServerKeyExchange, kx.data),
+		handshakeMessage(handshakeTypeServerHelloDone, nil),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if msg, err = c.readHandshake(handshakeTypeClientKeyExchange); err != nil {
+		return err
+	}
+
+	r = handshakeReader(msg)
+
+	yc := new(big.Int).SetBytes(r.vector(2))
+
+	if r.err != nil || len(r.data) != 0 {
+		return fmt.Errorf("invalid client key exchange")
+	}
+
+	if !dhPublicValueValid(c.dhPrime, yc) {
+		return fmt.Errorf("invalid client key exchange")
+	}
+
+	client, server, err := c.establishKeys(new(big.Int).Exp(yc, y, c.dhPrime).Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	if err = c.readFinished(client, adhFinishedLabelClient); err != nil {
+		return err
+	}
+
+	return c.sendFinished(server, adhFinishedLabelServer)
+}
+
+// validateDHParams checks group and public value received from server
+func validateDHParams(p, g, y *big.Int) error {
+	if p.BitLen() < minDHPrimeBits || p.Bit(0) == 0 {
+		return fmt.Errorf("dh prime is too small or invalid")
+	}
+
+	if !dhPublicValueValid(p, g) || !dhPublicValueValid(p, y) {
+		return fmt.Errorf("invalid dh parameters")
+	}
+
+	return nil
+}
+
+// dhPrivateKey generates random exponent in [2, p-2]
+func dhPrivateKey(p *big.Int) (*big.Int, error) {
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(p, big.NewInt(3)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return x.Add(x, big.NewInt(2)), nil
+}
+
+// adhPRF implements TLS 1.2 pseudorandom function
+func adhPRF(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	labelSeed := concat([]byte(label), seed)
+
+	mac := hmac.New(h, secret)
+	mac.Write(labelSeed)
+	a := mac.Sum(nil)
+
+	var out []byte
+
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelSeed)
+		out = mac.Sum(out)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+
+	return out[:n]
+}
+
+func concat(a, b []byte) []byte {
+	out := make([]byte, 0, len(a)+len(b))
+	return append(append(out, a...), b...)
+}
+
+func be24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func handshakeMessage(msgType byte, body []byte) []byte {
+	msg := make([]byte, 4, 4+len(body))
+	msg[0] = msgType
+	msg[1] = byte(len(body) >> 16)
+	msg[2] = byte(len(body) >> 8)
+	msg[3] = byte(len(body))
+
+	return append(msg, body...)
+}
+
+type handshakeBuilder struct {
+	data []byte
+}
+
+func newHandshakeBuilder() *handshakeBuilder {
+	return &handshakeBuilder{}
+}
+
+func (b *handshakeBuilder) uint8(v uint8) {
+	b.data = append(b.data, v)
+}
+
+func (b *handshakeBuilder) uint16(v uint16) {
+	b.data = append(b.data, byte(v>>8), byte(v))
+}
+
+func (b *handshakeBuilder) bytes(v []byte) {
+	b.data = append(b.data, v...)
+}
+
+// vector appends v prefixed with its length of n bytes
+func (b *handshakeBuilder) vector(n int, v []byte) {
+	for i := n - 1; i >= 0; i-- {
+		b.data = append(b.data, byte(len(v)>>(8*uint(i))))
+	}
+	b.data = append(b.data, v...)
+}
+
+// handshakeParser reads handshake message fields,
+// err is set once it runs out of data
+type handshakeParser struct {
+	data []byte
+	err  error
+}
+
+func handshakeReader(data []byte) *handshakeParser {
+	return &handshakeParser{data: data}
+}
+
+func (r *handshakeParser) next(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = fmt.Errorf("nrpe: truncated handshake message")
+		return make([]byte, n)
+	}
+
+	v := r.data[:n]
+	r.data = r.data[n:]
+
+	return v
+}
+
+func (r *handshakeParser) uint8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *handshakeParser) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+// vector reads data prefixed with its length of n bytes
+func (r *handshakeParser) vector(n int) []byte {
+	var length int
+
+	for _, b := range r.next(n) {
+		length = length<<8 | int(b)
+	}
+
+	return r.next(length)
+}
@@ -0,0 +1,248 @@
+//go:build cgo || nrpe_purego
+// +build cgo nrpe_purego
+
+package nrpe
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGoSSLClientServer(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	client, _ := newGoSSLClient(sock.client, nil)
+	server, _ := newGoSSLServerConn(sock.server, nil)
+
+	large := bytes.Repeat([]byte("0123456789"), 4000)
+
+	c := make(chan error)
+
+	go func() {
+		request := createPacket()
+
+		if err := readPacket(server, 0, request); err != nil {
+			c <- err
+			return
+		}
+
+		if err := verifyPacket(request, queryPacketType); err != nil {
+			c <- err
+			return
+		}
+
+		if _, err := server.Write(large); err != nil {
+			c <- err
+			return
+		}
+
+		c <- server.Close()
+	}()
+
+	if err := writePacket(client, 0, testBuildPacket(queryPacketType, 0, "test")); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(client)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, large) {
+		t.Fatal("Unexpected data")
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	if client.(*goSSLConn).suite.id != adhCipherSuiteAES256 {
+		t.Fatal("Expected AES256 cipher suite")
+	}
+}
+
+func TestGoSSLHandshakeError(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	client, _ := newGoSSLClient(sock.client, nil)
+
+	go func() {
+		// plain text server answering ssl client
+		request := make([]byte, packetLength)
+		sock.server.Read(request)
+		writePacket(sock.server, 0, testBuildPacket(responsePacketType, 0, "test"))
+	}()
+
+	_, err := client.Write([]byte("test"))
+
+	if err == nil || !strings.HasPrefix(err.Error(), "nrpe: error on ssl handshake") {
+		t.Fatal("Expected handshake error")
+	}
+
+	// handshake error is permanent
+	if _, err = client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected handshake error")
+	}
+}
+
+func TestGoSSLNoSharedCipher(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	server, _ := newGoSSLServerConn(sock.server, nil)
+
+	c := make(chan error)
+
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		c <- err
+	}()
+
+	hello := newHandshakeBuilder()
+	hello.uint16(tlsVersion12)
+	hello.bytes(make([]byte, tlsRandomLength))
+	hello.uint8(0)
+	hello.vector(2, []byte{0x00, 0x2f}) // TLS_RSA_WITH_AES_128_CBC_SHA
+	hello.vector(1, []byte{0})
+
+	client := &goSSLConn{Conn: sock.client, isClient: true}
+
+	if err := client.writeHandshake(handshakeMessage(handshakeTypeClientHello, hello.data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.readHandshake(handshakeTypeServerHello); err != adhAlert(alertHandshakeFailure) {
+		t.Fatalf("Expected handshake failure alert, got %v", err)
+	}
+
+	if err := <-c; err == nil || !strings.Contains(err.Error(), "no shared cipher") {
+		t.Fatalf("Expected no shared cipher error, got %v", err)
+	}
+}
+
+func TestGoSSLTamperedRecord(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	tampered := &testConn{Conn: sock.client}
+
+	client, _ := newGoSSLClient(tampered, nil)
+	server, _ := newGoSSLServerConn(sock.server, nil)
+
+	c := make(chan error)
+
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		c <- err
+	}()
+
+	if err := client.(*goSSLConn).Handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered.write = func(b []byte) (int, error) {
+		b[len(b)-1] ^= 1
+		return sock.client.Write(b)
+	}
+
+	if _, err := client.Write([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-c; err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("Expected authentication error, got %v", err)
+	}
+}
+
+func TestGoSSLHandshakeTooLong(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	server, _ := newGoSSLServerConn(sock.server, nil)
+
+	// client hello claiming 128KiB is rejected before it is buffered
+	sock.client.Write([]byte{recordTypeHandshake, 3, 3, 0, 4, handshakeTypeClientHello, 2, 0, 0})
+
+	err := server.Handshake(context.Background())
+
+	if err == nil || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("Expected error of long message, got %v", err)
+	}
+}
+
+func TestGoSSLCipherList(t *testing.T) {
+	tests := map[string][]uint16{
+		"ADH":                        {adhCipherSuiteAES256, adhCipherSuiteAES128},
+		"ALL:!ADH-AES256-GCM-SHA384": {adhCipherSuiteAES128},
+		"ADH-AES128-GCM-SHA256:ADH-AES256-GCM-SHA384": {adhCipherSuiteAES128, adhCipherSuiteAES256},
+		"TLS_DH_anon_WITH_AES_256_GCM_SHA384:RC4":     {adhCipherSuiteAES256},
+	}
+
+	for list, expected := range tests {
+		suites, err := adhCipherSuitesFromList(list)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(suites) != len(expected) {
+			t.Fatalf("Unexpected suites for %s", list)
+		}
+
+		for i := range suites {
+			if suites[i].id != expected[i] {
+				t.Fatalf("Unexpected suites for %s", list)
+			}
+		}
+	}
+
+	if _, err := adhCipherSuitesFromList("ADH:!ADH-AES256-GCM-SHA384:-ADH-AES128-GCM-SHA256"); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestGoSSLCipherListNegotiation(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	client, err := newGoSSLClient(sock.client, &SSLConfig{CipherList: "ADH-AES128-GCM-SHA256"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := newGoSSLServerConn(sock.server, nil)
+
+	c := make(chan error)
+
+	go func() {
+		_, err := server.Read(make([]byte, 4))
+		c <- err
+	}()
+
+	if _, err = client.Write([]byte("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	if client.(*goSSLConn).suite.id != adhCipherSuiteAES128 {
+		t.Fatal("Expected AES128 cipher suite")
+	}
+
+	if _, err = newGoSSLClient(sock.client, &SSLConfig{MinVersion: VersionTLS13}); err == nil {
+		t.Fatal("Expected version error")
+	}
+
+	if _, err = newGoSSLServerConn(sock.server, &SSLConfig{MaxVersion: VersionTLS11}); err == nil {
+		t.Fatal("Expected version error")
+	}
+}
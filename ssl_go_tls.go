@@ -0,0 +1,353 @@
+//go:build cgo || nrpe_purego
+// +build cgo nrpe_purego
+
+package nrpe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Certificate based ssl of the pure go implementation relies on crypto/tls,
+// anonymous DH is handled by goSSLConn.
+
+type goTLSConn struct {
+	*tls.Conn
+	verify            bool
+	handshakeDuration time.Duration
+}
+
+func newGoSSLClient(conn net.Conn, config *SSLConfig) (sslConnection, error) {
+	if config == nil {
+		config = anonymousSSLConfig
+	}
+
+	if !config.certificateMode(false) {
+		suites, err := goADHCipherSuites(config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &goSSLConn{Conn: conn, isClient: true, suites: suites}, nil
+	}
+
+	tlsConfig, err := getGoTLSConfig(config, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &goTLSConn{Conn: tls.Client(conn, tlsConfig), verify: config.CAFile != ""}, nil
+}
+
+func newGoSSLServerConn(conn net.Conn, config *SSLConfig) (sslConnection, error) {
+	if config == nil {
+		config = anonymousSSLConfig
+	}
+
+	if !config.certificateMode(true) {
+		suites, err := goADHCipherSuites(config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		params, err := getDHParams(config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &goSSLConn{
+			Conn:    conn,
+			dhPrime: params.P,
+			dhGen:   params.G,
+			suites:  suites,
+		}, nil
+	}
+
+	tlsConfig, err := getGoTLSConfig(config, true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &goTLSConn{Conn: tls.Server(conn, tlsConfig), verify: config.ClientCerts != NoClientCert}, nil
+}
+
+// getGoTLSConfig returns tls.Config of the config, creating it on first use
+func getGoTLSConfig(config *SSLConfig, server bool) (*tls.Config, error) {
+	tlsConfig, err := config.context(sslContextKey{"go", server}, func() (interface{}, error) {
+		return newGoTLSConfig(config, server)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsConfig.(*tls.Config), nil
+}
+
+// goADHCipherSuites returns anonymous suites enabled by the config,
+// the go implementation supports TLS 1.2 only
+func goADHCipherSuites(config *SSLConfig) ([]adhCipherSuite, error) {
+	min, max, err := config.versions(true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if min > VersionTLS12 || max < VersionTLS12 {
+		return nil, fmt.Errorf("nrpe: anonymous DH supports only %s", VersionTLS12)
+	}
+
+	return adhCipherSuitesFromList(config.CipherList)
+}
+
+// selectCipherSuites applies OpenSSL style cipher list to the suites
+// known by name. Named suites are used in the given order, other
+// entries like "ALL" or "HIGH" select all suites, entries prefixed
+// with "!" or "-" remove the named suite.
+func selectCipherSuites(list string, names map[string]uint16, all []uint16) ([]uint16, error) {
+	var selected []uint16
+
+	removed := make(map[uint16]bool)
+	named := false
+
+	for _, entry := range strings.FieldsFunc(list, func(r rune) bool { return r == ':' || r == ',' || r == ' ' }) {
+		switch entry[0] {
+		case '!', '-':
+			if id, ok := names[entry[1:]]; ok {
+				removed[id] = true
+			}
+			continue
+		case '+', '@':
+			continue
+		}
+
+		if id, ok := names[entry]; ok {
+			selected = append(selected, id)
+			named = true
+		}
+	}
+
+	if !named {
+		selected = all
+	}
+
+	var suites []uint16
+
+	for _, id := range selected {
+		if !removed[id] {
+			suites = append(suites, id)
+			removed[id] = true
+		}
+	}
+
+	if len(suites) == 0 {
+		return nil, fmt.Errorf("nrpe: no supported cipher suites in %q", list)
+	}
+
+	return suites, nil
+}
+
+func newGoTLSConfig(config *SSLConfig, server bool) (*tls.Config, error) {
+	if err := config.validate(server); err != nil {
+		return nil, err
+	}
+
+	min, max, err := config.versions(false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// keep TLS 1.2 as the default minimum unless older
+	// versions are requested explicitly
+	if min == 0 {
+		min = VersionTLS12
+
+		if max != 0 && max < VersionTLS12 {
+			min = VersionTLS10
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:             uint16(min),
+		MaxVersion:             uint16(max),
+		SessionTicketsDisabled: config.Options&SSLOptionNoTicket != 0,
+	}
+
+	if config.CipherList != "" {
+		names := make(map[string]uint16)
+		var all []uint16
+
+		for _, suite := range tls.CipherSuites() {
+			names[suite.Name] = suite.ID
+			all = append(all, suite.ID)
+		}
+
+		if tlsConfig.CipherSuites, err = selectCipherSuites(config.CipherList, names, all); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.keyFile())
+
+		if err != nil {
+			return nil, fmt.Errorf("nrpe: cannot load certificate: %v", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	var pool *x509.CertPool
+
+	if config.CAFile != "" {
+		data, err := os.ReadFile(config.CAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("nrpe: cannot load CA: %v", err)
+		}
+
+		pool = x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("nrpe: no certificates found in %s", config.CAFile)
+		}
+	}
+
+	if server {
+		tlsConfig.ClientCAs = pool
+
+		switch config.ClientCerts {
+		case RequestClientCert:
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		case RequireClientCert:
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		return tlsConfig, nil
+	}
+
+	// nrpe doesn't check host names, the server certificate
+	// is only verified against the CA
+	tlsConfig.InsecureSkipVerify = true
+
+	if pool != nil {
+		tlsConfig.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertificateChain(raw, pool)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func verifyCertificateChain(raw [][]byte, roots *x509.CertPool) error {
+	if len(raw) == 0 {
+		return fmt.Errorf("nrpe: no peer certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(raw))
+
+	for i, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+
+		if err != nil {
+			return err
+		}
+
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	return err
+}
+
+// Handshake runs the handshake unless it has already been done,
+// cancellation of ctx interrupts it. Read and Write call it implicitly.
+func (c *goTLSConn) Handshake(ctx context.Context) error {
+	if c.Conn.ConnectionState().HandshakeComplete {
+		return nil
+	}
+
+	start := time.Now()
+
+	err := c.Conn.HandshakeContext(ctx)
+
+	c.handshakeDuration = time.Since(start)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("nrpe: error on ssl handshake: %w", err)
+	}
+
+	return nil
+}
+
+func (c *goTLSConn) handshake() error {
+	return c.Handshake(context.Background())
+}
+
+func (c *goTLSConn) Read(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *goTLSConn) Write(b []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
+
+// Clean does nothing, crypto/tls holds no native resources
+func (c *goTLSConn) Clean() {
+}
+
+func (c *goTLSConn) sslState() *ConnectionState {
+	cs := c.Conn.ConnectionState()
+
+	if !cs.HandshakeComplete {
+		return &ConnectionState{}
+	}
+
+	// crypto/tls has no finite field DH key exchange
+	state := &ConnectionState{
+		Version:           SSLVersion(cs.Version),
+		CipherSuite:       cs.CipherSuite,
+		HandshakeDuration: c.handshakeDuration,
+	}
+
+	if len(cs.PeerCertificates) > 0 {
+		state.PeerCertificate = cs.PeerCertificates[0]
+		state.Verified = c.verify
+	}
+
+	return state
+}
@@ -0,0 +1,207 @@
+//go:build cgo && !nrpe_purego
+// +build cgo,!nrpe_purego
+
+package nrpe
+
+import (
+	"net"
+	"testing"
+)
+
+type testSSLConstructor func(net.Conn, *SSLConfig) (sslConnection, error)
+
+// testSSLInterop runs one query between ssl client and server
+// created by the given constructors
+func testSSLInterop(t *testing.T, newClient testSSLConstructor, clientConfig *SSLConfig,
+	newServer testSSLConstructor, serverConfig *SSLConfig) (client, server sslConnection) {
+
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	client, err := newClient(sock.client, clientConfig)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err = newServer(sock.server, serverConfig)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(client.Clean)
+	t.Cleanup(server.Clean)
+
+	c := make(chan error)
+
+	go func() {
+		request := createPacket()
+
+		if err := readPacket(server, 0, request); err != nil {
+			c <- err
+			return
+		}
+
+		if err := verifyPacket(request, queryPacketType); err != nil {
+			c <- err
+			return
+		}
+
+		c <- writePacket(server, 0, testBuildPacket(responsePacketType, StatusOK, "pong"))
+	}()
+
+	if err = writePacket(client, 0, testBuildPacket(queryPacketType, 0, "ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	response := createPacket()
+
+	if err = readPacket(client, 0, response); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifyPacket(response, responsePacketType); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := readCommandResult(response)
+
+	if err != nil || result.StatusLine != "pong" {
+		t.Fatal("Unexpected response")
+	}
+
+	return client, server
+}
+
+func TestSSLInteropGoClientOpenSSLServer(t *testing.T) {
+	testSSLInterop(t, newGoSSLClient, nil, newSSLServerConn, nil)
+}
+
+func TestSSLInteropOpenSSLClientGoServer(t *testing.T) {
+	testSSLInterop(t, newSSLClient, nil, newGoSSLServerConn, nil)
+}
+
+func TestSSLInteropCertificates(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	clientConfig := &SSLConfig{CertFile: certs.clientCert, KeyFile: certs.clientKey, CAFile: certs.ca}
+	serverConfig := &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey, CAFile: certs.ca,
+		ClientCerts: RequireClientCert}
+
+	constructors := [][2]testSSLConstructor{
+		{newGoSSLClient, newSSLServerConn},
+		{newSSLClient, newGoSSLServerConn},
+	}
+
+	for _, c := range constructors {
+		client, server := testSSLInterop(t, c[0], clientConfig, c[1], serverConfig)
+
+		if s := client.sslState(); !s.Verified || s.PeerCertificate.Subject.CommonName != "server" {
+			t.Fatal("Expected verified server certificate")
+		}
+
+		if s := server.sslState(); !s.Verified || s.PeerCertificate.Subject.CommonName != "client" {
+			t.Fatal("Expected verified client certificate")
+		}
+	}
+}
+
+func TestSSLInteropDHParams(t *testing.T) {
+	configs := []*SSLConfig{
+		{DHGroup: DHGroupMODP3072},
+		{DHGroup: DHGroupFFDHE4096},
+	}
+
+	for _, config := range configs {
+		testSSLInterop(t, newGoSSLClient, nil, newSSLServerConn, config)
+		testSSLInterop(t, newSSLClient, nil, newGoSSLServerConn, config)
+	}
+}
+
+func TestSSLInteropCipherList(t *testing.T) {
+	config := &SSLConfig{CipherList: "ADH-AES128-GCM-SHA256"}
+
+	client, _ := testSSLInterop(t, newGoSSLClient, config, newSSLServerConn, nil)
+
+	if client.(*goSSLConn).suite.id != adhCipherSuiteAES128 {
+		t.Fatal("Expected AES128 cipher suite")
+	}
+
+	_, server := testSSLInterop(t, newSSLClient, config, newGoSSLServerConn, nil)
+
+	if server.(*goSSLConn).suite.id != adhCipherSuiteAES128 {
+		t.Fatal("Expected AES128 cipher suite")
+	}
+}
+
+func TestSSLInteropVersionMismatch(t *testing.T) {
+	certs := testCreateCertificates(t)
+
+	clientConfig := &SSLConfig{CAFile: certs.ca, MinVersion: VersionTLS13}
+	serverConfig := &SSLConfig{CertFile: certs.serverCert, KeyFile: certs.serverKey, MaxVersion: VersionTLS12}
+
+	constructors := [][2]testSSLConstructor{
+		{newGoSSLClient, newSSLServerConn},
+		{newSSLClient, newGoSSLServerConn},
+	}
+
+	for _, c := range constructors {
+		sock := testCreateSocketPair(t)
+		defer sock.Close()
+
+		client, err := c[0](sock.client, clientConfig)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server, err := c[1](sock.server, serverConfig)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		errc := make(chan error)
+
+		go func() {
+			_, err := server.Read(make([]byte, 1))
+			sock.server.Close()
+			errc <- err
+		}()
+
+		if _, err = client.Write([]byte("test")); err == nil {
+			t.Fatal("Expected handshake error")
+		}
+
+		if err = <-errc; err == nil {
+			t.Fatal("Expected handshake error")
+		}
+
+		client.Clean()
+		server.Clean()
+	}
+}
+
+func TestSSLInteropConnectionState(t *testing.T) {
+	config := &SSLConfig{DHGroup: DHGroupMODP3072}
+
+	client, server := testSSLInterop(t, newGoSSLClient, nil, newSSLServerConn, config)
+
+	states := []*ConnectionState{client.sslState(), server.sslState()}
+
+	client, server = testSSLInterop(t, newSSLClient, nil, newGoSSLServerConn, config)
+
+	states = append(states, client.sslState(), server.sslState())
+
+	for _, state := range states {
+		if state.Version != VersionTLS12 || state.CipherSuite != adhCipherSuiteAES256 ||
+			state.DHBits != 3072 || state.HandshakeDuration <= 0 {
+			t.Fatalf("Unexpected state %+v", state)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package nrpe
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SSLVersion is TLS protocol version as sent on the wire
+type SSLVersion uint16
+
+const (
+	// VersionTLS10 is TLS 1.0
+	VersionTLS10 SSLVersion = 0x0301
+	// VersionTLS11 is TLS 1.1
+	VersionTLS11 SSLVersion = 0x0302
+	// VersionTLS12 is TLS 1.2
+	VersionTLS12 SSLVersion = 0x0303
+	// VersionTLS13 is TLS 1.3
+	VersionTLS13 SSLVersion = 0x0304
+)
+
+var sslVersionNames = map[SSLVersion]string{
+	VersionTLS10: "TLSv1",
+	VersionTLS11: "TLSv1.1",
+	VersionTLS12: "TLSv1.2",
+	VersionTLS13: "TLSv1.3",
+}
+
+func (v SSLVersion) String() string {
+	if name, ok := sslVersionNames[v]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("SSLVersion(%#04x)", uint16(v))
+}
+
+// ParseSSLVersion parses version the way ssl_version of nrpe.cfg does,
+// "TLSv1.2" allows only TLS 1.2, "TLSv1.2+" TLS 1.2 and newer.
+// Zero max means no upper limit.
+func ParseSSLVersion(s string) (min, max SSLVersion, err error) {
+	name := strings.TrimSuffix(s, "+")
+
+	for v, n := range sslVersionNames {
+		if strings.EqualFold(n, name) || (v == VersionTLS10 && strings.EqualFold("TLSv1.0", name)) {
+			if name == s {
+				return v, v, nil
+			}
+			return v, 0, nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("nrpe: unknown ssl version %q", s)
+}
+
+// SSLOptions are option flags of the ssl context
+type SSLOptions uint32
+
+const (
+	// SSLOptionAll enables OpenSSL bug workarounds (SSL_OP_ALL)
+	SSLOptionAll SSLOptions = 1 << iota
+	// SSLOptionCipherServerPreference makes the server choose
+	// cipher by its own preference
+	SSLOptionCipherServerPreference
+	// SSLOptionNoTicket disables session tickets
+	SSLOptionNoTicket
+	// SSLOptionNoCompression disables TLS compression
+	SSLOptionNoCompression
+	// SSLOptionNoRenegotiation disables renegotiation
+	SSLOptionNoRenegotiation
+)
+
+var sslOptionNames = []struct {
+	option SSLOptions
+	name   string
+}{
+	{SSLOptionAll, "all"},
+	{SSLOptionCipherServerPreference, "cipher_server_preference"},
+	{SSLOptionNoTicket, "no_ticket"},
+	{SSLOptionNoCompression, "no_compression"},
+	{SSLOptionNoRenegotiation, "no_renegotiation"},
+}
+
+func (o SSLOptions) String() string {
+	var names []string
+
+	for _, n := range sslOptionNames {
+		if o&n.option != 0 {
+			names = append(names, n.name)
+			o &^= n.option
+		}
+	}
+
+	if o != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(o)))
+	}
+
+	return strings.Join(names, ",")
+}
+
+// ParseSSLOptions parses comma separated option names, e.g.
+// "no_ticket,cipher_server_preference". OpenSSL style names
+// like SSL_OP_NO_TICKET are accepted as well.
+func ParseSSLOptions(s string) (SSLOptions, error) {
+	var options SSLOptions
+
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '|' || r == ' ' }) {
+		key := strings.ToLower(strings.TrimPrefix(strings.ToUpper(name), "SSL_OP_"))
+
+		found := false
+
+		for _, n := range sslOptionNames {
+			if n.name == key {
+				options |= n.option
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("nrpe: unknown ssl option %q", name)
+		}
+	}
+
+	return options, nil
+}
@@ -0,0 +1,88 @@
+package nrpe
+
+import (
+	"testing"
+)
+
+func TestParseSSLVersion(t *testing.T) {
+	tests := []struct {
+		s        string
+		min, max SSLVersion
+	}{
+		{"TLSv1", VersionTLS10, VersionTLS10},
+		{"TLSv1.0+", VersionTLS10, 0},
+		{"TLSv1.1", VersionTLS11, VersionTLS11},
+		{"tlsv1.2+", VersionTLS12, 0},
+		{"TLSv1.3", VersionTLS13, VersionTLS13},
+	}
+
+	for _, test := range tests {
+		min, max, err := ParseSSLVersion(test.s)
+
+		if err != nil || min != test.min || max != test.max {
+			t.Fatalf("Unexpected result for %s: %s %s %v", test.s, min, max, err)
+		}
+	}
+
+	for _, s := range []string{"", "+", "SSLv3", "TLSv1.4"} {
+		if _, _, err := ParseSSLVersion(s); err == nil {
+			t.Fatalf("Expected error for %q", s)
+		}
+	}
+
+	if VersionTLS12.String() != "TLSv1.2" || SSLVersion(0x0300).String() != "SSLVersion(0x0300)" {
+		t.Fatal("Unexpected version names")
+	}
+}
+
+func TestParseSSLOptions(t *testing.T) {
+	options, err := ParseSSLOptions("SSL_OP_NO_TICKET, cipher_server_preference|all")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options != SSLOptionNoTicket|SSLOptionCipherServerPreference|SSLOptionAll {
+		t.Fatal("Unexpected options")
+	}
+
+	if options.String() != "all,cipher_server_preference,no_ticket" {
+		t.Fatalf("Unexpected string %s", options)
+	}
+
+	if options, err = ParseSSLOptions(""); err != nil || options != 0 {
+		t.Fatal("Expected no options")
+	}
+
+	if _, err = ParseSSLOptions("no_ticket,bogus"); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	if (SSLOptionNoCompression | 1<<10).String() != "no_compression,0x400" {
+		t.Fatal("Unexpected string of unknown option")
+	}
+}
+
+func TestSSLConfigVersions(t *testing.T) {
+	config := &SSLConfig{MinVersion: VersionTLS11}
+
+	if min, max, err := config.versions(true); err != nil || min != VersionTLS11 || max != VersionTLS12 {
+		t.Fatal("Expected anonymous DH limited to TLS 1.2")
+	}
+
+	if min, max, err := config.versions(false); err != nil || min != VersionTLS11 || max != 0 {
+		t.Fatal("Expected no upper limit")
+	}
+
+	config = &SSLConfig{MinVersion: VersionTLS13}
+
+	if _, _, err := config.versions(true); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	config = &SSLConfig{MinVersion: VersionTLS12, MaxVersion: VersionTLS11}
+
+	if _, _, err := config.versions(false); err == nil {
+		t.Fatal("Expected error")
+	}
+}
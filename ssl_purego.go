@@ -0,0 +1,19 @@
+//go:build nrpe_purego
+// +build nrpe_purego
+
+package nrpe
+
+import (
+	"net"
+)
+
+// Building with the nrpe_purego tag replaces OpenSSL based implementation
+// with the pure go one, so the package can be built without cgo.
+
+func newSSLClient(conn net.Conn, config *SSLConfig) (sslConnection, error) {
+	return newGoSSLClient(conn, config)
+}
+
+func newSSLServerConn(conn net.Conn, config *SSLConfig) (sslConnection, error) {
+	return newGoSSLServerConn(conn, config)
+}
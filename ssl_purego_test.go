@@ -0,0 +1,41 @@
+//go:build nrpe_purego
+// +build nrpe_purego
+
+package nrpe
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestClientServerPureGoSsl(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	c := make(chan error)
+
+	go func() {
+		c <- ServeOne(sock.server, func(command Command) (*CommandResult, error) {
+			return &CommandResult{
+				StatusLine: ("CMD=" + command.Name + " ARGS=" + strings.Join(command.Args, ",")),
+				StatusCode: StatusOK,
+			}, nil
+		}, true, 0)
+	}()
+
+	command := NewCommand("check_something", "1", "2")
+
+	result, err := Run(sock.client, command, true, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	if result.StatusLine != ("CMD=" + command.Name + " ARGS=" + strings.Join(command.Args, ",")) {
+		t.Fatal("Unexpected response")
+	}
+}
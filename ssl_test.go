@@ -1,7 +1,12 @@
+//go:build cgo && !nrpe_purego
+// +build cgo,!nrpe_purego
+
 package nrpe
 
 import (
+	"context"
 	_ "fmt"
+	"io"
 	"strings"
 	"testing"
 	"time"
@@ -22,7 +27,7 @@ func TestClientServerSsl(t *testing.T) {
 		}, true, 0)
 
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 
 		c <- 1
@@ -57,7 +62,7 @@ func TestClientServerSslTimeoutOk(t *testing.T) {
 		}, true, 0)
 
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
 		}
 
 		c <- 1
@@ -93,7 +98,7 @@ func TestClientServerSslTimeoutServer(t *testing.T) {
 		}, true, 10)
 
 		if err == nil {
-			t.Fatal("Expected timeout")
+			t.Error("Expected timeout")
 		}
 
 		c <- 1
@@ -124,7 +129,7 @@ func TestClientServerSslTimeoutClient(t *testing.T) {
 		}, true, 1)
 
 		if err == nil {
-			t.Fatal("Expected timeout")
+			t.Error("Expected timeout")
 		}
 
 		c <- 1
@@ -144,7 +149,7 @@ func TestSslWritePanic(t *testing.T) {
 		panic("you shall not pass")
 	}
 
-	cl, err := newSSLClient(clientSock)
+	cl, err := newSSLClient(clientSock, nil)
 
 	if err != nil {
 		t.Fatal(err)
@@ -166,7 +171,7 @@ func TestSslReadPanic(t *testing.T) {
 		panic("you shall not pass")
 	}
 
-	sl, err := newSSLServerConn(serverSock)
+	sl, err := newSSLServerConn(serverSock, nil)
 
 	if err != nil {
 		t.Fatal(err)
@@ -182,17 +187,14 @@ func TestSslReadPanic(t *testing.T) {
 func TestSslReadError(t *testing.T) {
 	sock := testCreateSocketPair(t)
 
-	sl, err := newSSLServerConn(sock.server)
+	sl, err := newSSLServerConn(sock.server, nil)
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	connMap.lock.Lock()
-	for k := range connMap.values {
-		delete(connMap.values, k)
-	}
-	connMap.lock.Unlock()
+	// the BIO can't read from the closed connection
+	sock.server.Close()
 
 	_, err = sl.Read(make([]byte, 1))
 
@@ -204,17 +206,14 @@ func TestSslReadError(t *testing.T) {
 func TestSslWriteError(t *testing.T) {
 	sock := testCreateSocketPair(t)
 
-	cl, err := newSSLClient(sock.client)
+	cl, err := newSSLClient(sock.client, nil)
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	connMap.lock.Lock()
-	for k := range connMap.values {
-		delete(connMap.values, k)
-	}
-	connMap.lock.Unlock()
+	// the BIO can't write to the closed connection
+	sock.client.Close()
 
 	_, err = cl.Write(make([]byte, 1))
 
@@ -226,27 +225,23 @@ func TestSslWriteError(t *testing.T) {
 func TestSslCloseError(t *testing.T) {
 	sock := testCreateSocketPair(t)
 
-	cl, err := newSSLClient(sock.client)
+	cl, err := newSSLClient(sock.client, nil)
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(connMap.values) != 1 {
-		t.Fatal("connection map contains too many elements")
-	}
-
 	cl.Close()
 
-	if len(connMap.values) != 0 {
-		t.Fatal("connection map must be empty")
+	if cl.(*sslConn).ssl != nil || cl.(*sslConn).state != stateClosed {
+		t.Fatal("ssl must be released on close")
 	}
 }
 
 func TestSslWriteStateError(t *testing.T) {
 	sock := testCreateSocketPair(t)
 
-	cl, err := newSSLClient(sock.client)
+	cl, err := newSSLClient(sock.client, nil)
 
 	if err != nil {
 		t.Fatal(err)
@@ -264,7 +259,7 @@ func TestSslWriteStateError(t *testing.T) {
 func TestSslReadStateError(t *testing.T) {
 	sock := testCreateSocketPair(t)
 
-	cl, err := newSSLClient(sock.client)
+	cl, err := newSSLClient(sock.client, nil)
 
 	if err != nil {
 		t.Fatal(err)
@@ -278,3 +273,164 @@ func TestSslReadStateError(t *testing.T) {
 		t.Fatal("Expected error")
 	}
 }
+
+func TestSslShortReads(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	// deliver data to openssl one byte at a time
+	serverSock := &testConn{Conn: sock.server}
+
+	serverSock.read = func(b []byte) (n int, err error) {
+		return sock.server.Read(b[:1])
+	}
+
+	c := make(chan int)
+
+	go func() {
+		err := ServeOne(serverSock, func(command Command) (*CommandResult, error) {
+			return &CommandResult{StatusLine: "OK", StatusCode: StatusOK}, nil
+		}, true, 5*time.Second)
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		c <- 1
+	}()
+
+	result, err := Run(sock.client, NewCommand("check_something"), true, 5*time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.StatusLine != "OK" {
+		t.Fatal("Unexpected response")
+	}
+
+	<-c
+}
+
+func TestSslContextShared(t *testing.T) {
+	config := &SSLConfig{}
+
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	c1, err := newSSLClient(sock.client, config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c1.Clean()
+
+	c2, err := newSSLClient(sock.client, config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer c2.Clean()
+
+	s, err := newSSLServerConn(sock.server, config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Clean()
+
+	if c1.(*sslConn).ctx != c2.(*sslConn).ctx {
+		t.Fatal("Expected shared client context")
+	}
+
+	if c1.(*sslConn).ctx == s.(*sslConn).ctx {
+		t.Fatal("Expected separate server context")
+	}
+}
+
+func TestSslHandshakeOnceAndCloseNotify(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	cl, _ := newSSLClient(sock.client, nil)
+	sl, _ := newSSLServerConn(sock.server, nil)
+
+	c := make(chan error)
+
+	go func() {
+		c <- sl.Handshake(context.Background())
+	}()
+
+	if err := cl.Handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	if cl.(*sslConn).state != stateReady || sl.(*sslConn).state != stateReady {
+		t.Fatal("Expected ready state")
+	}
+
+	// handshake is done only once
+	if err := cl.Handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// peer sees clean shutdown instead of an error
+	if _, err := sl.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+
+	cl.Clean()
+	sl.Clean()
+	sl.Clean()
+
+	if _, err := sl.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected error on cleaned connection")
+	}
+}
+
+func TestSslCloseDuringRead(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	cl, _ := newSSLClient(sock.client, nil)
+	sl, _ := newSSLServerConn(sock.server, nil)
+
+	defer cl.Clean()
+
+	go cl.Handshake(context.Background())
+
+	if err := sl.Handshake(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client never writes, so the read blocks until close
+	c := make(chan error, 1)
+
+	go func() {
+		_, err := sl.Read(make([]byte, 1))
+		c <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	sl.Close()
+
+	if err := <-c; err == nil {
+		t.Fatal("Expected error of interrupted read")
+	}
+
+	if _, err := sl.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected error on closed connection")
+	}
+}
@@ -0,0 +1,167 @@
+package nrpe
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var statusNames = map[CommandStatus]string{
+	StatusOK:       "OK",
+	StatusWarning:  "WARNING",
+	StatusCritical: "CRITICAL",
+	StatusUnknown:  "UNKNOWN",
+}
+
+var statusAliases = map[string]CommandStatus{
+	"OK":       StatusOK,
+	"WARN":     StatusWarning,
+	"WARNING":  StatusWarning,
+	"CRIT":     StatusCritical,
+	"CRITICAL": StatusCritical,
+	"UNKNOWN":  StatusUnknown,
+}
+
+// String returns nagios name of the status
+func (s CommandStatus) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+
+	return "CommandStatus(" + strconv.Itoa(int(s)) + ")"
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (s CommandStatus) MarshalText() ([]byte, error) {
+	if name, ok := statusNames[s]; ok {
+		return []byte(name), nil
+	}
+
+	return nil, fmt.Errorf("nrpe: Unknown status code %d", int(s))
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *CommandStatus) UnmarshalText(text []byte) error {
+	status, err := ParseCommandStatus(string(text))
+
+	if err != nil {
+		return err
+	}
+
+	*s = status
+
+	return nil
+}
+
+// UnmarshalJSON accepts status either as a name or as a number
+func (s *CommandStatus) UnmarshalJSON(data []byte) error {
+	var name string
+
+	if err := json.Unmarshal(data, &name); err == nil {
+		return s.UnmarshalText([]byte(name))
+	}
+
+	var code int
+
+	if err := json.Unmarshal(data, &code); err != nil {
+		return fmt.Errorf("nrpe: invalid status %s", data)
+	}
+
+	return s.UnmarshalText([]byte(strconv.Itoa(code)))
+}
+
+// ParseCommandStatus parses status from its name (case insensitive,
+// "WARN" and "CRIT" abbreviations are accepted) or numeric code
+func ParseCommandStatus(s string) (CommandStatus, error) {
+	if status, ok := statusAliases[strings.ToUpper(strings.TrimSpace(s))]; ok {
+		return status, nil
+	}
+
+	code, err := strconv.Atoi(strings.TrimSpace(s))
+
+	if err == nil {
+		if _, ok := statusNames[CommandStatus(code)]; ok {
+			return CommandStatus(code), nil
+		}
+	}
+
+	return StatusUnknown, fmt.Errorf("nrpe: invalid status %q", s)
+}
+
+// statusRank orders statuses by severity the way nagios does,
+// UNKNOWN ranks between WARNING and CRITICAL
+func statusRank(s CommandStatus) int {
+	switch s {
+	case StatusOK:
+		return 0
+	case StatusWarning:
+		return 1
+	case StatusCritical:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// WorstStatus returns the most severe of the statuses using nagios
+// ordering OK < WARNING < UNKNOWN < CRITICAL.
+// StatusUnknown is returned if no statuses are given.
+func WorstStatus(statuses ...CommandStatus) CommandStatus {
+	if len(statuses) == 0 {
+		return StatusUnknown
+	}
+
+	worst := statuses[0]
+
+	for _, s := range statuses[1:] {
+		if statusRank(s) > statusRank(worst) {
+			worst = s
+		}
+	}
+
+	return worst
+}
+
+// BestStatus returns the least severe of the statuses.
+// StatusUnknown is returned if no statuses are given.
+func BestStatus(statuses ...CommandStatus) CommandStatus {
+	if len(statuses) == 0 {
+		return StatusUnknown
+	}
+
+	best := statuses[0]
+
+	for _, s := range statuses[1:] {
+		if statusRank(s) < statusRank(best) {
+			best = s
+		}
+	}
+
+	return best
+}
+
+// MajorityStatus returns the most frequent of the statuses, ties are
+// resolved in favour of the more severe status.
+// StatusUnknown is returned if no statuses are given.
+func MajorityStatus(statuses ...CommandStatus) CommandStatus {
+	if len(statuses) == 0 {
+		return StatusUnknown
+	}
+
+	counts := make(map[CommandStatus]int)
+
+	majority := statuses[0]
+
+	for _, s := range statuses {
+		counts[s]++
+
+		if counts[s] > counts[majority] ||
+			counts[s] == counts[majority] && statusRank(s) > statusRank(majority) {
+
+			majority = s
+		}
+	}
+
+	return majority
+}
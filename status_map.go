@@ -0,0 +1,125 @@
+package nrpe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Failure classifies checks which didn't receive status
+type Failure int
+
+const (
+	// FailureConnect is failed connect
+	FailureConnect Failure = iota
+	// FailureTimeout is timeout of any operation including connect
+	FailureTimeout
+	// FailureProtocol is any other failure, e.g. ssl handshake
+	// or invalid response
+	FailureProtocol
+)
+
+// StatusRule remaps status From of Command results to To
+type StatusRule struct {
+	// Command is the command name, empty matches all commands
+	Command string
+	From    CommandStatus
+	To      CommandStatus
+}
+
+// StatusMap maps failures and received statuses to the final
+// status of checks
+type StatusMap struct {
+	// Failures maps failures to status, unmapped failures are UNKNOWN
+	Failures map[Failure]CommandStatus
+	// Rules remap received statuses, the first matching rule applies
+	Rules []StatusRule
+}
+
+// classifyFailure returns failure class of check error
+func classifyFailure(err error) Failure {
+	var netErr net.Error
+	var dialErr dialError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		return FailureTimeout
+	case errors.As(err, &dialErr):
+		return FailureConnect
+	default:
+		return FailureProtocol
+	}
+}
+
+// FailureStatus returns status of check which failed with err
+func (m *StatusMap) FailureStatus(err error) CommandStatus {
+	if status, ok := m.Failures[classifyFailure(err)]; ok {
+		return status
+	}
+
+	return StatusUnknown
+}
+
+// RemoteStatus returns status received for command remapped by the rules
+func (m *StatusMap) RemoteStatus(command string, status CommandStatus) CommandStatus {
+	for _, rule := range m.Rules {
+		if (rule.Command == "" || rule.Command == command) && rule.From == status {
+			return rule.To
+		}
+	}
+
+	return status
+}
+
+// Apply returns the final result of command checked with the given
+// result and error. Failures become results with error as status line.
+// Results of a client with StatusMap set are already remapped, mapping
+// them again would apply the rules twice.
+func (m *StatusMap) Apply(command Command, result *CommandResult, err error) *CommandResult {
+	if err != nil {
+		return &CommandResult{StatusLine: err.Error(), StatusCode: m.FailureStatus(err)}
+	}
+
+	mapped := *result
+	mapped.StatusCode = m.RemoteStatus(command.Name, result.StatusCode)
+
+	return &mapped
+}
+
+// ParseStatusRules parses comma separated rules FROM=TO, which apply
+// to all commands, or COMMAND:FROM=TO, e.g. "check_disk:WARNING=OK"
+func ParseStatusRules(s string) ([]StatusRule, error) {
+	var rules []StatusRule
+
+	for _, r := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		var rule StatusRule
+
+		statuses := r
+
+		if i := strings.LastIndex(r, ":"); i != -1 {
+			rule.Command, statuses = r[:i], r[i+1:]
+		}
+
+		from, to, found := strings.Cut(statuses, "=")
+
+		if !found {
+			return nil, fmt.Errorf("nrpe: invalid status rule %q", r)
+		}
+
+		var err error
+
+		if rule.From, err = ParseCommandStatus(from); err != nil {
+			return nil, err
+		}
+
+		if rule.To, err = ParseCommandStatus(to); err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,153 @@
+package nrpe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatusMapFailures(t *testing.T) {
+	m := &StatusMap{
+		Failures: map[Failure]CommandStatus{
+			FailureConnect: StatusCritical,
+			FailureTimeout: StatusWarning,
+		},
+	}
+
+	refused := dialError{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	dialTimeout := dialError{&net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}}
+
+	for _, c := range []struct {
+		err      error
+		expected CommandStatus
+	}{
+		{refused, StatusCritical},
+		{errors.Join(refused, refused), StatusCritical},
+		{dialTimeout, StatusWarning},
+		{context.DeadlineExceeded, StatusWarning},
+		{handshakeError{errors.New("handshake failure")}, StatusUnknown},
+		{fmt.Errorf("nrpe: Response crc didn't match"), StatusUnknown},
+	} {
+		if status := m.FailureStatus(c.err); status != c.expected {
+			t.Fatalf("Expected %v for %v, got %v", c.expected, c.err, status)
+		}
+	}
+}
+
+func TestStatusMapApply(t *testing.T) {
+	m := &StatusMap{
+		Rules: []StatusRule{
+			{Command: "check_disk", From: StatusWarning, To: StatusOK},
+			{From: StatusCritical, To: StatusWarning},
+		},
+	}
+
+	result := &CommandResult{StatusLine: "DISK WARNING", StatusCode: StatusWarning}
+
+	mapped := m.Apply(NewCommand("check_disk"), result, nil)
+
+	if mapped.StatusCode != StatusOK || mapped.StatusLine != result.StatusLine || result.StatusCode != StatusWarning {
+		t.Fatalf("Unexpected mapping %+v of %+v", mapped, result)
+	}
+
+	if mapped = m.Apply(NewCommand("check_load"), result, nil); mapped.StatusCode != StatusWarning {
+		t.Fatalf("Rule of other command applied: %+v", mapped)
+	}
+
+	result.StatusCode = StatusCritical
+
+	if mapped = m.Apply(NewCommand("check_load"), result, nil); mapped.StatusCode != StatusWarning {
+		t.Fatalf("Expected rule for all commands: %+v", mapped)
+	}
+
+	mapped = m.Apply(NewCommand("check_load"), nil, errors.New("nrpe: error while reading"))
+
+	if mapped.StatusCode != StatusUnknown || mapped.StatusLine != "nrpe: error while reading" {
+		t.Fatalf("Unexpected failure result %+v", mapped)
+	}
+}
+
+func TestStatusMapClientTimeout(t *testing.T) {
+	sock := testCreateSocketPair(t)
+	defer sock.Close()
+
+	go sock.server.Read(make([]byte, packetLength))
+
+	client := Client{ReadTimeout: 50 * time.Millisecond}
+
+	_, err := client.Run(context.Background(), sock.client, NewCommand("check"))
+
+	m := &StatusMap{Failures: map[Failure]CommandStatus{FailureTimeout: StatusCritical}}
+
+	if status := m.FailureStatus(err); status != StatusCritical {
+		t.Fatalf("Expected timeout status for %v, got %v", err, status)
+	}
+}
+
+func TestClientStatusMap(t *testing.T) {
+	var inFlight, maxInFlight int32
+
+	client := testBatchClient(t, &inFlight, &maxInFlight)
+	client.StatusMap = &StatusMap{Rules: []StatusRule{{Command: "check_mapped", From: StatusWarning, To: StatusOK}}}
+
+	targets := []Target{
+		{Address: "ok-1", Command: NewCommand("check_mapped")},
+		{Address: "ok-2", Command: NewCommand("check_other")},
+	}
+
+	expected := []CommandStatus{StatusOK, StatusWarning}
+
+	client.CheckAll(context.Background(), targets, 0, func(r TargetResult) {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+
+		if r.Result.StatusCode != expected[r.Index] {
+			t.Fatalf("Expected %v for %s, got %v", expected[r.Index], r.Target.Command.Name, r.Result.StatusCode)
+		}
+	})
+}
+
+func TestStatusMapLookupFailure(t *testing.T) {
+	client := &Client{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, errors.New("network unreachable")
+			},
+		},
+	}
+
+	_, err := client.LookupSRV(context.Background(), "_nrpe._tcp.example.com")
+
+	if failure := classifyFailure(err); failure != FailureConnect {
+		t.Fatalf("Expected connect failure, got %d: %v", failure, err)
+	}
+}
+
+func TestParseStatusRules(t *testing.T) {
+	rules, err := ParseStatusRules("warning=ok, check_disk:CRIT=1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []StatusRule{
+		{From: StatusWarning, To: StatusOK},
+		{Command: "check_disk", From: StatusCritical, To: StatusWarning},
+	}
+
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, rules)
+	}
+
+	for _, s := range []string{"WARNING", "WARNING=BROKEN", "check_disk:5=OK"} {
+		if _, err = ParseStatusRules(s); err == nil {
+			t.Fatalf("Expected error for %q", s)
+		}
+	}
+}
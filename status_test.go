@@ -0,0 +1,114 @@
+package nrpe
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCommandStatusString(t *testing.T) {
+	names := map[CommandStatus]string{
+		StatusOK:       "OK",
+		StatusWarning:  "WARNING",
+		StatusCritical: "CRITICAL",
+		StatusUnknown:  "UNKNOWN",
+		10:             "CommandStatus(10)",
+	}
+
+	for status, name := range names {
+		if status.String() != name {
+			t.Fatalf("Expected %q, got %q", name, status.String())
+		}
+	}
+}
+
+func TestParseCommandStatus(t *testing.T) {
+	valid := map[string]CommandStatus{
+		"ok":       StatusOK,
+		"Warning":  StatusWarning,
+		"WARN":     StatusWarning,
+		"crit":     StatusCritical,
+		"CRITICAL": StatusCritical,
+		" unknown": StatusUnknown,
+		"2":        StatusCritical,
+	}
+
+	for s, expected := range valid {
+		status, err := ParseCommandStatus(s)
+
+		if err != nil || status != expected {
+			t.Fatalf("Unexpected result for %q", s)
+		}
+	}
+
+	for _, s := range []string{"", "bad", "4", "-1"} {
+		if _, err := ParseCommandStatus(s); err == nil {
+			t.Fatalf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestCommandStatusJSON(t *testing.T) {
+	var v struct {
+		Status CommandStatus `json:"status"`
+	}
+
+	v.Status = StatusCritical
+
+	data, err := json.Marshal(v)
+
+	if err != nil || string(data) != `{"status":"CRITICAL"}` {
+		t.Fatalf("Unexpected json %s", data)
+	}
+
+	if err = json.Unmarshal([]byte(`{"status":"warning"}`), &v); err != nil ||
+		v.Status != StatusWarning {
+
+		t.Fatal("Unexpected status from name")
+	}
+
+	if err = json.Unmarshal([]byte(`{"status":3}`), &v); err != nil ||
+		v.Status != StatusUnknown {
+
+		t.Fatal("Unexpected status from number")
+	}
+
+	if err = json.Unmarshal([]byte(`{"status":true}`), &v); err == nil {
+		t.Fatal("Expected error")
+	}
+
+	v.Status = 10
+
+	if _, err = json.Marshal(v); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestStatusAggregation(t *testing.T) {
+	if WorstStatus(StatusOK, StatusUnknown, StatusWarning) != StatusUnknown {
+		t.Fatal("UNKNOWN must be worse than WARNING")
+	}
+
+	if WorstStatus(StatusCritical, StatusUnknown) != StatusCritical {
+		t.Fatal("CRITICAL must be worse than UNKNOWN")
+	}
+
+	if BestStatus(StatusCritical, StatusUnknown, StatusWarning) != StatusWarning {
+		t.Fatal("WARNING must be better than UNKNOWN")
+	}
+
+	if MajorityStatus(StatusOK, StatusCritical, StatusOK, StatusWarning) != StatusOK {
+		t.Fatal("Expected OK majority")
+	}
+
+	if MajorityStatus(StatusWarning, StatusCritical, StatusOK, StatusCritical, StatusWarning) !=
+		StatusCritical {
+
+		t.Fatal("Expected tie to be resolved to CRITICAL")
+	}
+
+	if WorstStatus() != StatusUnknown || BestStatus() != StatusUnknown ||
+		MajorityStatus() != StatusUnknown {
+
+		t.Fatal("Expected UNKNOWN for empty input")
+	}
+}